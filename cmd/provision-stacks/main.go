@@ -0,0 +1,142 @@
+// provision-stacks runs `pulumi up` for several stacks of the provisioning
+// program concurrently and prints a summary table. A failing stack doesn't
+// stop the others. With -check it only previews the stacks and exits non-zero
+// if any of them would change, which suits a scheduled drift check.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+)
+
+type stackResult struct {
+	name     string
+	status   string
+	duration time.Duration
+	detail   string
+}
+
+func resourceChanges(summary auto.UpdateSummary) string {
+	if summary.ResourceChanges == nil {
+		return ""
+	}
+
+	changes := *summary.ResourceChanges
+	var parts []string
+	for _, op := range slices.Sorted(maps.Keys(changes)) {
+		parts = append(parts, fmt.Sprintf("%s=%d", op, changes[op]))
+	}
+	return strings.Join(parts, " ")
+}
+
+func provisionStack(ctx context.Context, name string, workDir string) stackResult {
+	start := time.Now()
+
+	stack, err := auto.SelectStackLocalSource(ctx, name, workDir)
+	if err != nil {
+		return stackResult{name, "failed", time.Since(start), fmt.Sprintf("failed to select stack: %v", err)}
+	}
+
+	res, err := stack.Up(ctx)
+	if err != nil {
+		return stackResult{name, "failed", time.Since(start), err.Error()}
+	}
+
+	return stackResult{name, res.Summary.Result, time.Since(start), resourceChanges(res.Summary)}
+}
+
+// checkStack previews the stack, its status is "unchanged" unless something
+// other than a no-op is planned.
+func checkStack(ctx context.Context, name string, workDir string) stackResult {
+	start := time.Now()
+
+	stack, err := auto.SelectStackLocalSource(ctx, name, workDir)
+	if err != nil {
+		return stackResult{name, "failed", time.Since(start), fmt.Sprintf("failed to select stack: %v", err)}
+	}
+
+	res, err := stack.Preview(ctx)
+	if err != nil {
+		return stackResult{name, "failed", time.Since(start), err.Error()}
+	}
+
+	status := "unchanged"
+	var parts []string
+	for _, op := range slices.Sorted(maps.Keys(res.ChangeSummary)) {
+		parts = append(parts, fmt.Sprintf("%s=%d", op, res.ChangeSummary[op]))
+		if op != apitype.OpSame && res.ChangeSummary[op] > 0 {
+			status = "changed"
+		}
+	}
+	return stackResult{name, status, time.Since(start), strings.Join(parts, " ")}
+}
+
+func main() {
+	maxConcurrency := flag.Int("maxConcurrency", 2, "maximum number of stacks provisioned at the same time")
+	workDir := flag.String("workDir", ".", "directory containing Pulumi.yaml")
+	check := flag.Bool("check", false, "only preview the stacks and report whether they would change")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] <stack>...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	stacks := flag.Args()
+	if len(stacks) == 0 || *maxConcurrency < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	run, want := provisionStack, "succeeded"
+	if *check {
+		run, want = checkStack, "unchanged"
+	}
+
+	ctx := context.Background()
+	results := make([]stackResult, len(stacks))
+	sem := make(chan struct{}, *maxConcurrency)
+
+	var wg sync.WaitGroup
+	for i, name := range stacks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			fmt.Printf("%s: started\n", name)
+			results[i] = run(ctx, name, *workDir)
+			fmt.Printf("%s: %s\n", name, results[i].status)
+		}()
+	}
+	wg.Wait()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STACK\tSTATUS\tDURATION\tDETAIL")
+
+	failed := false
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.name, r.status, r.duration.Round(time.Second), r.detail)
+		failed = failed || r.status != want
+	}
+	w.Flush()
+
+	if failed {
+		os.Exit(1)
+	}
+	if *check {
+		fmt.Println("no changes needed")
+	}
+}
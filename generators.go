@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SSHTarget is where generated scripts run the commands.
+type SSHTarget struct {
+	User string
+	Host string
+	Port int
+}
+
+// writeGeneratedFile writes data to name with perm even if name exists with
+// a looser mode, by writing a temporary file and renaming it into place.
+// Generated files may contain secrets.
+func writeGeneratedFile(name string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// WorkflowConfig describes the GitHub Actions workflow that runs `pulumi up`
+// for a stack, exposing the named repository secrets to the program.
+type WorkflowConfig struct {
+	Stack   string
+	Secrets []string
+}
+
+func generateGHAWorkflow(cfg WorkflowConfig) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, `name: provision-%s
+
+on:
+  workflow_dispatch:
+
+jobs:
+  provision:
+    runs-on: ubuntu-latest
+    steps:
+      - uses: actions/checkout@v4
+      - uses: actions/setup-go@v5
+        with:
+          go-version-file: go.mod
+      - uses: pulumi/actions@v6
+        with:
+          command: up
+          stack-name: %s
+        env:
+          PULUMI_ACCESS_TOKEN: ${{ secrets.PULUMI_ACCESS_TOKEN }}
+`, cfg.Stack, cfg.Stack)
+
+	for _, s := range cfg.Secrets {
+		fmt.Fprintf(&b, "          %s: ${{ secrets.%s }}\n", s, s)
+	}
+
+	return b.String()
+}
+
+// generateCloudInit returns a #cloud-config user-data document that runs the
+// commands in order as username. cloud-init itself runs them as root.
+func generateCloudInit(commands []CommandSpec, username string) string {
+	var cloudConfig struct {
+		RunCmd [][]string `yaml:"runcmd"`
+	}
+	for _, c := range commands {
+		cloudConfig.RunCmd = append(cloudConfig.RunCmd, []string{"sudo", "-iu", username, "sh", "-c", c.command()})
+	}
+
+	data, err := yaml.Marshal(cloudConfig)
+	if err != nil {
+		// Only strings, marshalling can't fail
+		panic(err)
+	}
+	return "#cloud-config\n" + string(data)
+}
+
+// generateProvisionScript returns a shell script that runs the commands in
+// order over ssh, waiting for the host after those that reboot it.
+func generateProvisionScript(commands []CommandSpec, target SSHTarget) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, `#!/bin/sh
+# Runs the provisioning without Pulumi
+set -eu
+
+SSH_TARGET="${SSH_TARGET:-%s@%s}"
+SSH_PORT="${SSH_PORT:-%d}"
+
+run() {
+	echo "==> $1" >&2
+	ssh -p "$SSH_PORT" "$SSH_TARGET" "$2"
+}
+
+wait_for_reboot() {
+	sleep 30
+	until ssh -p "$SSH_PORT" "$SSH_TARGET" true; do sleep 5; done
+}
+`, target.User, target.Host, target.Port)
+
+	for _, c := range commands {
+		fmt.Fprintf(&b, "\nrun %s %s\n", c.Name, shellQuote(c.command()))
+		if c.RequiresReboot {
+			b.WriteString("wait_for_reboot\n")
+		}
+	}
+
+	return b.String()
+}
+
+// generateMakefile returns a Makefile with a target per command, depending
+// on the commands it has to run after, and the setup and extra targets for
+// each group. The ordered commands are chained like runOrderedCommands does.
+// Commands are sent base64 encoded since recipes can't span lines.
+func generateMakefile(ordered, independent []CommandSpec, target SSHTarget) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, `SSH_TARGET ?= %s@%s
+SSH_PORT ?= %d
+SSH = ssh -p $(SSH_PORT) $(SSH_TARGET)
+
+.PHONY: all setup extra
+all: setup extra
+`, target.User, target.Host, target.Port)
+
+	chained := slices.Clone(ordered)
+	var last string
+	for i, c := range chained {
+		if c.Parallel {
+			continue
+		}
+		if last != "" {
+			chained[i].After = append(slices.Clone(c.After), last)
+		}
+		last = c.Name
+	}
+
+	for _, group := range []struct {
+		name     string
+		commands []CommandSpec
+	}{
+		{"setup", chained},
+		{"extra", independent},
+	} {
+		var names []string
+		for _, c := range group.commands {
+			names = append(names, c.Name)
+		}
+		fmt.Fprintf(&b, "\n%s: %s\n", group.name, strings.Join(names, " "))
+
+		for _, c := range group.commands {
+			fmt.Fprintf(&b, "\n.PHONY: %s\n%s\n", c.Name, strings.TrimSpace(fmt.Sprintf("%s: %s", c.Name, strings.Join(c.After, " "))))
+			fmt.Fprintf(&b, "\techo %s | base64 -d | $(SSH) sh -s\n", base64.StdEncoding.EncodeToString([]byte(c.command())))
+			if c.RequiresReboot {
+				b.WriteString("\tsleep 30 && until $(SSH) true; do sleep 5; done\n")
+			}
+		}
+	}
+
+	return b.String()
+}
+
+// dockerBaseImage returns the image a distribution's Dockerfile starts from
+// and the command that installs sudo in it, which the commands rely on.
+func dockerBaseImage(distribution string) (string, string, error) {
+	switch distribution {
+	case "fedora":
+		return "fedora:latest", "dnf install -y sudo", nil
+	case "amazonlinux2023":
+		return "amazonlinux:2023", "dnf install -y sudo shadow-utils", nil
+	case "ubuntu":
+		return "ubuntu:24.04", "apt-get update && apt-get install -y sudo", nil
+	case "debian":
+		return "debian:stable", "apt-get update && apt-get install -y sudo", nil
+	case "arch":
+		return "archlinux:latest", "pacman -Sy --needed --noconfirm sudo", nil
+	case "gentoo":
+		return "gentoo/stage3:latest", "emerge --sync && emerge --noreplace app-admin/sudo", nil
+	default:
+		return "", "", fmt.Errorf("no container image for %s", distribution)
+	}
+}
+
+// hostOnlyTools need a running systemd or the host's kernel, docker build
+// has neither.
+var hostOnlyTools = []string{"systemctl", "loginctl", "sysctl", "udevadm", "/sys/", "sudo mount "}
+
+// generateDockerfile returns a Dockerfile that runs the commands in order as
+// username, who gets passwordless sudo like on a provisioned machine. Each
+// command is a heredoc, since they may span lines. Containers don't reboot,
+// so RequiresReboot is ignored. Secret commands are left out, image layers
+// are readable by anyone who can pull the image. Commands using
+// hostOnlyTools only run if systemd is, like on WSL, so never during the
+// build.
+func generateDockerfile(distribution, username string, commands []CommandSpec) (string, error) {
+	image, installSudo, err := dockerBaseImage(distribution)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `# syntax=docker/dockerfile:1
+FROM %s
+
+ENV DEBIAN_FRONTEND=noninteractive
+RUN %s && useradd -m %s && echo '%s ALL=(ALL) NOPASSWD:ALL' > /etc/sudoers.d/%s
+USER %s
+WORKDIR /home/%s
+`, image, installSudo, username, username, username, username, username)
+
+	for _, c := range commands {
+		if c.Secret {
+			continue
+		}
+
+		c.RequiresReboot = false
+		if slices.ContainsFunc(hostOnlyTools, func(tool string) bool { return strings.Contains(c.Cmd, tool) }) {
+			c.Condition = addCondition(c.Condition, systemdRunning)
+		}
+		fmt.Fprintf(&b, "\n# %s\nRUN <<'DEVENV'\n%s\nDEVENV\n", c.Name, c.command())
+	}
+
+	return b.String(), nil
+}
+
+// generateNixFlake returns a flake.nix whose default dev shell has the
+// packages and crates from nixpkgs, for every system nixpkgs builds on. Most
+// of the common package and crate names are nixpkgs attributes too. Versions
+// come from the nixpkgs revision in flake.lock, crate pins don't apply.
+func generateNixFlake(packages []string, cargoPackages []string) string {
+	var attrs strings.Builder
+	for _, p := range slices.Concat(packages, cargoPackages) {
+		fmt.Fprintf(&attrs, "              pkgs.%q\n", p)
+	}
+
+	return fmt.Sprintf(`{
+  description = "Development environment";
+
+  inputs.nixpkgs.url = "github:NixOS/nixpkgs/nixos-unstable";
+
+  outputs = { self, nixpkgs }:
+    let
+      forAllSystems = nixpkgs.lib.genAttrs [ "x86_64-linux" "aarch64-linux" "x86_64-darwin" "aarch64-darwin" ];
+    in
+    {
+      devShells = forAllSystems (system:
+        let
+          pkgs = nixpkgs.legacyPackages.${system};
+        in
+        {
+          default = pkgs.mkShell {
+            packages = [
+%s            ];
+          };
+        });
+    };
+}
+`, attrs.String())
+}
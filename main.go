@@ -1,164 +1,3898 @@
 package main
 
 import (
+	"cmp"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	_ "embed"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"maps"
+	"math/big"
+	"net"
 	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode"
 
+	"github.com/pulumi/pulumi-command/sdk/go/command/local"
 	"github.com/pulumi/pulumi-command/sdk/go/command/remote"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
 )
 
-const commonPackages = "autoconf automake bpftrace clang cmake curl gcc gdb git htop less libtool llvm lnav man-db mold pkgconf sysstat zsh"
-const cargoPackages = "bat csvlens hexyl hyperfine qsv xan"
+//go:embed packages.yaml
+var defaultPackageManifest []byte
 
-func installCmd(distribution string) (string, error) {
-	switch distribution {
-	case "fedora":
-		return "sudo dnf install -y", nil
-	case "ubuntu", "debian":
-		return "sudo apt-get install -y", nil
+// PackageManifest lists the packages to install, see packages.yaml.
+type PackageManifest struct {
+	CommonPackages  []string                     `yaml:"commonPackages"`
+	CargoPackages   []CargoPinnedPackage         `yaml:"cargoPackages"`
+	DistroPackages  map[string][]string          `yaml:"distroPackages"`
+	Profiles        map[string]HostProfile       `yaml:"profiles"`
+	PackageNames    map[string]map[string]string `yaml:"packageNames"`
+	ArchUnavailable map[string][]string          `yaml:"archUnavailable"`
+}
+
+// HostProfile adds packages and commands for one kind of machine on top of
+// the common ones. A profile with a Distribution only applies to it.
+type HostProfile struct {
+	Name               string               `json:"name" yaml:"name"`
+	Distribution       string               `json:"distribution" yaml:"distribution"`
+	ExtraPackages      []string             `json:"extraPackages" yaml:"extraPackages"`
+	CargoPackages      []CargoPinnedPackage `json:"cargoPackages" yaml:"cargoPackages"`
+	AdditionalCommands []CommandSpec        `json:"additionalCommands" yaml:"additionalCommands"`
+}
+
+// profile looks up the named profile in the manifest, profiles from the
+// config replace manifest ones with the same name.
+func (m PackageManifest) profile(name, distribution string, custom map[string]HostProfile) (HostProfile, error) {
+	p, ok := custom[name]
+	if !ok {
+		p, ok = m.Profiles[name]
+	}
+	if !ok {
+		return HostProfile{}, fmt.Errorf("unknown profile: %s", name)
+	}
+
+	if p.Distribution != "" && p.Distribution != distribution {
+		return HostProfile{}, fmt.Errorf("profile '%s' is for %s, not %s", name, p.Distribution, distribution)
+	}
+	if p.Name == "" {
+		p.Name = name
+	}
+	return p, nil
+}
+
+// loadPackageManifest reads the manifest at file, or the embedded default if
+// file is empty.
+func loadPackageManifest(file string) (PackageManifest, error) {
+	data := defaultPackageManifest
+	if file != "" {
+		var err error
+		if data, err = os.ReadFile(file); err != nil {
+			return PackageManifest{}, err
+		}
+	}
+
+	var m PackageManifest
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return PackageManifest{}, err
+	}
+	return m, nil
+}
+
+func (m PackageManifest) extraPackagesForDistro(distribution string) []string {
+	return slices.Clone(m.DistroPackages[distribution])
+}
+
+// distroPackageNames replaces package names with the distribution's own
+// names for them, if it has any.
+func (m PackageManifest) distroPackageNames(distribution string, packages []string) []string {
+	names := m.PackageNames[distribution]
+
+	renamed := make([]string, len(packages))
+	for i, p := range packages {
+		if name, ok := names[p]; ok {
+			p = name
+		}
+		renamed[i] = p
+	}
+	return renamed
+}
+
+// CargoPinnedPackage is a crate installed by install-cargo-packages, at the
+// latest version unless Version is set.
+type CargoPinnedPackage struct {
+	Name    string `json:"name" yaml:"name"`
+	Version string `json:"version" yaml:"version"`
+}
+
+// UnmarshalJSON also accepts a plain crate name, as used before versions
+// could be pinned.
+func (p *CargoPinnedPackage) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*p = CargoPinnedPackage{Name: name}
+		return nil
+	}
+
+	type plain CargoPinnedPackage
+	return json.Unmarshal(data, (*plain)(p))
+}
+
+// UnmarshalYAML accepts a plain crate name as well.
+func (p *CargoPinnedPackage) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*p = CargoPinnedPackage{Name: value.Value}
+		return nil
+	}
+
+	type plain CargoPinnedPackage
+	return value.Decode((*plain)(p))
+}
+
+// parseCargoPackages reads the cargoPackages config value, either a JSON array
+// or the older space separated list of crate names.
+func parseCargoPackages(value string) ([]CargoPinnedPackage, error) {
+	if !strings.HasPrefix(strings.TrimSpace(value), "[") {
+		var crates []CargoPinnedPackage
+		for _, name := range strings.Fields(value) {
+			crates = append(crates, CargoPinnedPackage{Name: name})
+		}
+		return crates, nil
+	}
+
+	var crates []CargoPinnedPackage
+	if err := json.Unmarshal([]byte(value), &crates); err != nil {
+		return nil, err
+	}
+	return crates, nil
+}
+
+// cargoInstallCmd installs unpinned crates in one go, pinned ones need their
+// own invocation since --version applies to a single crate.
+func cargoInstallCmd(crates []CargoPinnedPackage) string {
+	var latest []string
+	var cmds []string
+	for _, c := range crates {
+		if c.Version == "" {
+			latest = append(latest, c.Name)
+		} else {
+			cmds = append(cmds, fmt.Sprintf("~/.cargo/bin/cargo install %s --version %s --locked", c.Name, c.Version))
+		}
+	}
+
+	if len(latest) > 0 {
+		cmds = slices.Insert(cmds, 0, fmt.Sprintf("~/.cargo/bin/cargo install %s", strings.Join(latest, " ")))
+	}
+	return strings.Join(cmds, " && ")
+}
+
+// Shell conditions for CommandSpec.Condition and SkipIf
+const (
+	zshInstalled      = "command -v zsh > /dev/null"
+	cargoMissing      = "[ ! -f ~/.cargo/bin/cargo ]"
+	systemdRunning    = "[ -d /run/systemd/system ]"
+	starshipInstalled = "command -v starship > /dev/null"
+	uvInstalled       = "[ -x ~/.local/bin/uv ]"
+	nixMissing        = "[ ! -x /nix/var/nix/profiles/default/bin/nix ]"
+)
+
+// CommandSpec is a single remote command.
+type CommandSpec struct {
+	Name string
+	Cmd  string
+	// Condition is a shell expression, the command only runs if it holds
+	Condition string
+	// Secret commands are never logged and are stored encrypted in the state
+	Secret bool
+	// After names commands, created earlier in any group, that have to
+	// finish first
+	After []string
+	// RequiresReboot reboots the host once the command succeeds, ordered
+	// commands wait for it to come back
+	RequiresReboot bool
+	// Env is exported before the command runs
+	Env map[string]string
+	// Container names the distrobox the command runs in, empty means the host
+	Container string
+	// Timeout replaces Pulumi's default create timeout when non-zero
+	Timeout time.Duration
+	// SkipIf is a shell expression, the command is skipped if it holds
+	SkipIf string
+	// NotifyHandler names a handler of the command's group to run once the
+	// command ran
+	NotifyHandler string
+	// Trigger runs the command again whenever it changes
+	Trigger string
+	// Session runs the command in a tmux session of that name, see wrapInTmux
+	Session string
+	// Template commands have Cmd rendered with TemplateVars
+	Template bool
+	// RerunWithAfter commands also run again whenever a command in After is
+	// replaced
+	RerunWithAfter bool
+	// Parallel ordered commands only wait for After, and the next ordered
+	// command doesn't wait for them
+	Parallel bool
+}
+
+// CommandGroup is a set of commands with the handlers they notify. A handler
+// runs once, after all of the group's commands, whenever a command notifying
+// it ran. Handlers no command notifies never run.
+type CommandGroup struct {
+	Name     string
+	Commands []CommandSpec
+	Handlers []CommandSpec
+}
+
+// notifiedHandlers returns the handlers with the commands that notify them
+// added to After.
+func (g CommandGroup) notifiedHandlers() []CommandSpec {
+	var handlers []CommandSpec
+	for _, h := range g.Handlers {
+		for _, c := range g.Commands {
+			if c.NotifyHandler == h.Name {
+				h.After = append(slices.Clone(h.After), c.Name)
+			}
+		}
+		if len(h.After) > 0 {
+			handlers = append(handlers, h)
+		}
+	}
+	return handlers
+}
+
+// command returns the shell command that is actually run on the remote host.
+func (c CommandSpec) command() string {
+	cmd := c.Cmd
+	if c.RequiresReboot {
+		cmd = fmt.Sprintf("%s && %s", cmd, rebootCmd)
+	}
+
+	if c.Condition != "" {
+		cmd = conditionalCmd(c.Condition, cmd)
+	}
+	if c.SkipIf != "" {
+		cmd = conditionalCmd(fmt.Sprintf("! ( %s )", c.SkipIf), cmd)
+	}
+
+	if len(c.Env) > 0 {
+		var vars []string
+		for _, k := range slices.Sorted(maps.Keys(c.Env)) {
+			vars = append(vars, fmt.Sprintf("%s=%s", k, shellQuote(c.Env[k])))
+		}
+		cmd = fmt.Sprintf("export %s && %s", strings.Join(vars, " "), cmd)
+	}
+
+	if c.Container != "" {
+		cmd = fmt.Sprintf("distrobox enter --name %s -- sh -c %s", c.Container, shellQuote(cmd))
+	}
+	if c.Session != "" {
+		cmd = wrapInTmux(cmd, c.Session)
+	}
+	return cmd
+}
+
+// wrapInTmux runs cmd in a detached tmux session, so it keeps running when
+// the SSH connection drops, and waits for it. The command is saved as a
+// script rather than typed into the session, its output and exit status go
+// to files next to it. All of them are only readable by their owner, the
+// script is removed once it ran, the others once they were printed.
+//
+// The session is named after sessionName and a hash of cmd. When a run is
+// retried after the connection dropped, the session from the interrupted
+// run, or its results, are still there and waited on. A waiter left over
+// from the interrupted run gives up once the results are gone. Sessions of
+// older versions of the command are ended. Until install-packages has installed
+// tmux, cmd runs directly. Secret commands must not be wrapped.
+func wrapInTmux(cmd string, sessionName string) string {
+	prefix := strings.Map(func(r rune) rune {
+		if isSafeName(string(r)) {
+			return r
+		}
+		return '-'
+	}, sessionName)
+	session := fmt.Sprintf("%s-%x", prefix, sha256.Sum256([]byte(cmd)))[:len(prefix)+9]
+
+	base := "~/.cache/devenv/" + session
+	keys := fmt.Sprintf(`umask 077; "$SHELL" %s.sh > %s.log 2>&1; echo $? > %s.tmp && mv %s.tmp %s.status; rm -f %s.sh; exit`, base, base, base, base, base, base)
+	start := strings.Join([]string{
+		fmt.Sprintf("rm -f %s.log %s.status", base, base),
+		fmt.Sprintf("(umask 077 && %s)", writeFileCmd(base+".sh", cmd)),
+		fmt.Sprintf("tmux new-session -d -s %s", session),
+		fmt.Sprintf("tmux send-keys -t %s %s Enter", session, shellQuote(keys)),
+	}, " && ")
+
+	tmux := strings.Join([]string{
+		fmt.Sprintf(`for s in $(tmux list-sessions -F '#S' 2> /dev/null | grep -x '%s-[0-9a-f]\{8\}' | grep -vx %s); do tmux kill-session -t "=$s"; rm -f ~/.cache/devenv/"$s".*; done`, prefix, session),
+		fmt.Sprintf("(tmux has-session -t =%s 2> /dev/null || [ -f %s.status ] || (%s))", session, base, start),
+		fmt.Sprintf("while [ ! -f %s.status ]; do (tmux has-session -t =%s 2> /dev/null || [ -f %s.status ]) || exit 1; sleep 2; done", base, session, base),
+		fmt.Sprintf("cat %s.log", base),
+		fmt.Sprintf("status=$(cat %s.status)", base),
+		fmt.Sprintf("rm -f %s.log %s.status", base, base),
+		`exit "$status"`,
+	}, " && ")
+	return fmt.Sprintf("if command -v tmux > /dev/null; then %s; else %s; fi", tmux, cmd)
+}
+
+// display returns the command as it may appear in logs and errors.
+func (c CommandSpec) display() string {
+	if c.Secret {
+		return "<secret>"
+	}
+	return c.command()
+}
+
+// rebootCmd schedules the reboot instead of running it, so the command exits
+// cleanly before the connection drops.
+const rebootCmd = "sudo systemd-run --on-active=5 systemctl reboot"
+
+// normalizeArch maps a uname -m value to its Go name, which targetArch
+// uses. Other values are returned as is.
+func normalizeArch(unameMach string) string {
+	switch unameMach {
+	case "x86_64":
+		return "amd64"
+	case "aarch64", "arm64":
+		return "arm64"
 	default:
-		return "", fmt.Errorf("unsupported distribution: %s", distribution)
+		return unameMach
 	}
 }
 
-func updateCmd(distribution string) (string, error) {
-	switch distribution {
-	case "fedora":
-		return "sudo dnf update -y", nil
-	case "ubuntu", "debian":
-		return "sudo apt-get update && sudo apt-get dist-upgrade -y", nil
+// unameArch is the reverse of normalizeArch, Linux's name for arch, which
+// also starts Rust and GNU target triples.
+func unameArch(arch string) string {
+	switch arch {
+	case "amd64":
+		return "x86_64"
+	case "arm64":
+		return "aarch64"
 	default:
-		return "", fmt.Errorf("unsupported distribution: %s", distribution)
+		return arch
+	}
+}
+
+// archCondition holds when the remote machine runs on arch, which may be
+// given as a uname -m value or as its Go name ("amd64", "arm64").
+func archCondition(arch string) string {
+	return fmt.Sprintf("[ \"$(uname -m)\" = '%s' ]", unameArch(arch))
+}
+
+func conditionalCmd(condition, cmd string) string {
+	return fmt.Sprintf("if %s; then %s; fi", condition, cmd)
+}
+
+// addCondition returns the condition that holds when both do, existing may
+// be empty.
+func addCondition(existing, condition string) string {
+	if existing == "" {
+		return condition
+	}
+	return fmt.Sprintf("%s && %s", condition, existing)
+}
+
+// NFSMount is an NFS export mounted at the absolute MountPoint via /etc/fstab.
+type NFSMount struct {
+	Server     string `json:"server"`
+	Path       string `json:"path"`
+	MountPoint string `json:"mountPoint"`
+	Options    string `json:"options"`
+}
+
+// validate checks that the mount can go into the preflight command and an
+// fstab line as it is.
+func (m NFSMount) validate() error {
+	if net.ParseIP(m.Server) == nil && !isHostname(m.Server) {
+		return fmt.Errorf("NFS server must be a hostname or an IP address: %s", m.Server)
+	}
+	if !path.IsAbs(m.MountPoint) || strings.ContainsFunc(m.MountPoint, unicode.IsSpace) {
+		return fmt.Errorf("NFS mount point must be an absolute path without whitespace: %s", m.MountPoint)
+	}
+
+	unsafe := func(r rune) bool { return unicode.IsSpace(r) || strings.ContainsRune("'\"`", r) }
+	if strings.ContainsFunc(m.Path, unsafe) {
+		return fmt.Errorf("NFS path must not contain whitespace or quotes: %s", m.Path)
+	}
+	if strings.ContainsFunc(m.Options, unsafe) {
+		return fmt.Errorf("NFS options must not contain whitespace or quotes: %s", m.Options)
+	}
+	return nil
+}
+
+// isHostname reports whether name is made of dot separated labels of
+// letters, digits and inner hyphens.
+func isHostname(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
 	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		if strings.Trim(label, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+			return false
+		}
+	}
+	return true
 }
 
-func extraPackagesForDistro(distribution string) []string {
+func nfsClientPackage(distribution string) string {
 	switch distribution {
-	case "fedora":
-		return []string{"fedora-packager", "fedora-review", "gcc-c++", "ninja", "perf"}
+	case "fedora", "fedora-silverblue", "amazonlinux2023", "rhel", "arch":
+		return "nfs-utils"
+	case "gentoo":
+		return "net-fs/nfs-utils"
 	case "ubuntu", "debian":
-		return []string{"g++", "linux-tools-virtual", "ninja-build"}
+		return "nfs-common"
 	default:
-		return []string{}
+		return ""
 	}
 }
 
-func runIndependentCommands(ctx *pulumi.Context, commands []struct {
-	name string
-	cmd  string
-}, connection remote.ConnectionArgs) error {
-	for _, c := range commands {
-		ctx.Log.Info(fmt.Sprintf("%s: '%s'", c.name, c.cmd), nil)
+// nfsPreflightCmd fails unless every NFS server accepts connections.
+func nfsPreflightCmd(mounts []NFSMount) string {
+	var cmds []string
+	for _, m := range mounts {
+		cmds = append(cmds, fmt.Sprintf("timeout 5 bash -c '</dev/tcp/%s/2049'", m.Server))
+	}
+	return strings.Join(cmds, " && ")
+}
 
-		_, err := remote.NewCommand(ctx, c.name, &remote.CommandArgs{
-			Connection: connection,
-			Create:     pulumi.String(c.cmd),
-			Triggers:   pulumi.Array{pulumi.String(c.cmd)},
-		})
-		if err != nil {
-			return fmt.Errorf("failed to run command '%s': %w", c.cmd, err)
+// nfsSetupCmd adds the fstab entries and mounts them. fstab separates fields
+// with whitespace, so the mount point can't contain any.
+func nfsSetupCmd(mounts []NFSMount) (string, error) {
+	var cmds []string
+	for _, m := range mounts {
+		if err := m.validate(); err != nil {
+			return "", err
+		}
+
+		mountPoint := shellQuote(m.MountPoint)
+		options := m.Options
+		if options == "" {
+			options = "defaults"
 		}
+
+		entry := shellQuote(fmt.Sprintf("%s:%s %s nfs %s 0 0", m.Server, m.Path, m.MountPoint, options))
+		cmds = append(cmds,
+			fmt.Sprintf("(grep -qxF %s /etc/fstab || echo %s | sudo tee -a /etc/fstab > /dev/null)", entry, entry),
+			fmt.Sprintf("sudo mkdir -p %s", mountPoint),
+			fmt.Sprintf("(mountpoint -q %s || sudo mount %s)", mountPoint, mountPoint),
+		)
 	}
-	return nil
+	return strings.Join(cmds, " && "), nil
 }
 
-func runOrderedCommands(ctx *pulumi.Context, commands []struct {
-	name string
-	cmd  string
-}, connection remote.ConnectionArgs) error {
-	var lastResource pulumi.Resource
+// sshHostKeyFromSeed derives the host's ed25519 key from a secret seed so the
+// host identity survives reprovisioning.
+func sshHostKeyFromSeed(seed string) ed25519.PrivateKey {
+	h := sha256.Sum256([]byte("ssh-host-ed25519:" + seed))
+	return ed25519.NewKeyFromSeed(h[:])
+}
 
-	for _, c := range commands {
+// sshRSAHostKeyFromSeed derives the host's 2048 bit RSA key from the seed.
+// crypto/rsa ignores the random source it's given, so the primes are searched
+// for here, starting from a SHA-256 counter stream of the seed.
+func sshRSAHostKeyFromSeed(seed string) (*rsa.PrivateKey, error) {
+	var counter uint64
+	stream := func(n int) []byte {
+		var b []byte
+		for len(b) < n {
+			h := sha256.Sum256(binary.BigEndian.AppendUint64([]byte("ssh-host-rsa:"+seed), counter))
+			b = append(b, h[:]...)
+			counter++
+		}
+		return b[:n]
+	}
 
-		var opts []pulumi.ResourceOption
-		if lastResource != nil {
-			opts = append(opts, pulumi.DependsOn([]pulumi.Resource{lastResource}))
+	// The top two bits make the modulus exactly 2048 bits
+	two := big.NewInt(2)
+	prime := func() *big.Int {
+		for {
+			b := stream(128)
+			b[0] |= 0xc0
+			b[len(b)-1] |= 1
+			p := new(big.Int).SetBytes(b)
+			for !p.ProbablyPrime(20) {
+				p.Add(p, two)
+			}
+			if p.BitLen() == 1024 {
+				return p
+			}
 		}
+	}
 
-		ctx.Log.Info(fmt.Sprintf("%s: '%s'", c.name, c.cmd), nil)
-		r, err := remote.NewCommand(ctx, c.name, &remote.CommandArgs{
-			Connection: connection,
-			Create:     pulumi.String(c.cmd),
-			Triggers:   pulumi.Array{pulumi.String(c.cmd)},
-		}, opts...)
+	e := big.NewInt(65537)
+	one := big.NewInt(1)
+	for {
+		p, q := prime(), prime()
+		if p.Cmp(q) == 0 {
+			continue
+		}
 
-		if err != nil {
-			return fmt.Errorf("failed to run command '%s': %w", c.cmd, err)
+		phi := new(big.Int).Mul(new(big.Int).Sub(p, one), new(big.Int).Sub(q, one))
+		d := new(big.Int).ModInverse(e, phi)
+		if d == nil {
+			continue
 		}
 
-		lastResource = r
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: new(big.Int).Mul(p, q), E: int(e.Int64())},
+			D:         d,
+			Primes:    []*big.Int{p, q},
+		}
+		if err := key.Validate(); err != nil {
+			return nil, err
+		}
+		key.Precompute()
+		return key, nil
 	}
-	return nil
 }
 
-func main() {
-	pulumi.Run(func(ctx *pulumi.Context) error {
-		cfg := config.New(ctx, ctx.Stack())
-		distribution := cfg.Require("distribution")
-		sshUsername := cfg.Require("sshUsername")
+// marshalED25519PrivateKey encodes key in the OpenSSH private key format.
+// Unlike ssh.MarshalPrivateKey the check bytes come from the key itself,
+// which keeps the output, and so the command trigger, stable.
+func marshalED25519PrivateKey(key ed25519.PrivateKey) []byte {
+	pub := key.Public().(ed25519.PublicKey)
+	check := binary.BigEndian.Uint32(pub)
+
+	priv := ssh.Marshal(struct {
+		Check1  uint32
+		Check2  uint32
+		KeyType string
+		Pub     []byte
+		Priv    []byte
+		Comment string
+	}{check, check, ssh.KeyAlgoED25519, pub, key, ""})
+	for i := 1; len(priv)%8 != 0; i++ {
+		priv = append(priv, byte(i))
+	}
+
+	blob := ssh.Marshal(struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}{"none", "none", "", 1, ssh.Marshal(struct {
+		KeyType string
+		Pub     []byte
+	}{ssh.KeyAlgoED25519, pub}), priv})
+
+	return pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: append([]byte("openssh-key-v1\x00"), blob...)})
+}
+
+// sshHostKeyCmd writes the host keys derived from seed to /etc/ssh. The
+// private keys are written under umask 077, so they're never readable by
+// anyone else, even before the chmod for files that already existed.
+func sshHostKeyCmd(seed string) (string, error) {
+	edKey := sshHostKeyFromSeed(seed)
+	rsaKey, err := sshRSAHostKeyFromSeed(seed)
+	if err != nil {
+		return "", err
+	}
 
-		key, err := os.ReadFile(os.ExpandEnv("$HOME/.orbstack/ssh/id_ed25519"))
+	var cmds []string
+	for _, k := range []struct {
+		file string
+		priv []byte
+		pub  crypto.PublicKey
+	}{
+		{"/etc/ssh/ssh_host_ed25519_key", marshalED25519PrivateKey(edKey), edKey.Public()},
+		// sshd reads PEM encoded RSA keys, which unlike the OpenSSH format
+		// have no random check bytes
+		{"/etc/ssh/ssh_host_rsa_key", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), &rsaKey.PublicKey},
+	} {
+		pub, err := ssh.NewPublicKey(k.pub)
 		if err != nil {
-			return fmt.Errorf("failed to read private key: %w", err)
+			return "", err
 		}
+		cmds = append(cmds,
+			fmt.Sprintf("(umask 077 && %s)", sudoWriteFileCmd(k.file, strings.TrimSpace(string(k.priv)))),
+			"sudo chmod 600 "+k.file,
+			sudoWriteFileCmd(k.file+".pub", strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))),
+			fmt.Sprintf("sudo chmod 644 %s.pub", k.file),
+		)
+	}
+	cmds = append(cmds, "(sudo systemctl restart sshd || sudo systemctl restart ssh)")
+	return strings.Join(cmds, " && "), nil
+}
 
-		connection := remote.ConnectionArgs{
-			Host:       pulumi.String("localhost"),
-			Port:       pulumi.Float64(32222),
-			User:       pulumi.String(sshUsername),
-			PrivateKey: pulumi.String(string(key)),
-		}
+// TemplateVars are available to Template commands as {{.Username}} etc.
+type TemplateVars struct {
+	Username     string
+	Distribution string
+	Arch         string
+}
+
+func renderCommand(tmpl string, vars TemplateVars) (string, error) {
+	t, err := template.New("command").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	if err := t.Execute(&b, vars); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
 
-		installCmd, err := installCmd(distribution)
+// renderCommands renders the Template commands. The others are left alone,
+// they may contain {{ from the config.
+func renderCommands(commands []CommandSpec, vars TemplateVars) error {
+	for i, c := range commands {
+		if !c.Template {
+			continue
+		}
+		cmd, err := renderCommand(c.Cmd, vars)
 		if err != nil {
-			return fmt.Errorf("failed to get install command: %w", err)
+			return fmt.Errorf("failed to render command '%s': %w", c.Name, err)
 		}
+		commands[i].Cmd = cmd
+	}
+	return nil
+}
 
-		updateCmd, err := updateCmd(distribution)
-		if err != nil {
-			return fmt.Errorf("failed to get update command: %w", err)
+// AptPin pins a package to a version, Priority defaults to 1001 which
+// allows downgrades.
+type AptPin struct {
+	Package  string `json:"package"`
+	Version  string `json:"version"`
+	Priority string `json:"priority"`
+}
+
+func aptPinsCmd(pins []AptPin) string {
+	var entries []string
+	for _, p := range pins {
+		priority := p.Priority
+		if priority == "" {
+			priority = "1001"
 		}
+		entries = append(entries, fmt.Sprintf("Package: %s\nPin: version %s\nPin-Priority: %s", p.Package, p.Version, priority))
+	}
+	return sudoWriteFileCmd("/etc/apt/preferences.d/99-devenv", strings.Join(entries, "\n\n"))
+}
+
+// UdevRule is a udev rules file written to /etc/udev/rules.d/<Name>.rules
+type UdevRule struct {
+	Name    string `json:"name"`
+	Content string `json:"content"`
+}
 
-		extraPackages := extraPackagesForDistro(distribution)
+// AsdfPlugin is an asdf plugin, from the shortname repository unless URL is
+// set.
+type AsdfPlugin struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
 
-		// These commands need to be run in order
-		setup_commands := []struct {
-			name string
-			cmd  string
-		}{
-			{"update-system", updateCmd},
-			{"install-packages", fmt.Sprintf("sudo %s %s %s", installCmd, commonPackages, strings.Join(extraPackages, " "))},
-			{"install-cargo", "curl -LsSf https://sh.rustup.rs | sh -s -- -y --no-modify-path"},
-			// zsh is not setup yet, we need full path to cargo
-			{"install-cargo-packages", fmt.Sprintf("~/.cargo/bin/cargo install %s", cargoPackages)},
-			{"setup-config", "rm -rf ~/github/config && git clone https://github.com/ismail/config.git ~/github/config && ~/github/config/setup.sh"},
-			{"setup-hacks", "rm -rf ~/github/hacks && git clone https://github.com/ismail/hacks.git ~/github/hacks && ~/github/hacks/setup.sh"},
-			{"set-zlogin", "echo 'path+=(~/.local/bin ~/.cargo/bin $path)\n\neval \"$(starship init zsh)\"' > ~/.zlogin"},
-			{"use-zsh", "sudo chsh -s /bin/zsh ismail"},
+// asdfVersion is the last asdf release that installs with git clone, later
+// ones are a single binary without asdf global.
+const asdfVersion = "v0.15.0"
+
+// asdfCommands installs asdf and the plugins, then each tool's version,
+// which also becomes the global one. Tools without a plugin get the
+// shortname one. The installs run one after another, asdf global rewrites
+// ~/.tool-versions.
+func asdfCommands(plugins []AsdfPlugin, versions map[string]string) []CommandSpec {
+	cmds := []CommandSpec{{
+		Name:      "install-asdf",
+		Cmd:       fmt.Sprintf("git clone https://github.com/asdf-vm/asdf.git ~/.asdf --branch %s", asdfVersion),
+		Condition: "[ ! -d ~/.asdf ]",
+		After:     []string{"install-packages"},
+	}}
+
+	tools := slices.Sorted(maps.Keys(versions))
+	for _, tool := range tools {
+		if !slices.ContainsFunc(plugins, func(p AsdfPlugin) bool { return p.Name == tool }) {
+			plugins = append(plugins, AsdfPlugin{Name: tool})
+		}
+	}
+	for _, p := range plugins {
+		cmd := fmt.Sprintf(". ~/.asdf/asdf.sh && asdf plugin add %s", shellQuote(p.Name))
+		if p.URL != "" {
+			cmd += " " + shellQuote(p.URL)
 		}
+		cmds = append(cmds, CommandSpec{
+			Name:   "asdf-plugin-" + p.Name,
+			Cmd:    cmd,
+			SkipIf: fmt.Sprintf("[ -d ~/.asdf/plugins/%s ]", shellQuote(p.Name)),
+			After:  []string{"install-asdf"},
+		})
+	}
 
-		// These run independently
-		extra_commands := []struct {
-			name string
-			cmd  string
-		}{
-			{"install-starship", "curl -sS https://starship.rs/install.sh | sudo sh -s -- -y"},
-			{"install-uv", "curl -LsSf https://astral.sh/uv/install.sh | UV_NO_MODIFY_PATH=1 sh"},
+	previous := ""
+	for _, tool := range tools {
+		c := CommandSpec{
+			Name:  "asdf-install-" + tool,
+			Cmd:   fmt.Sprintf(". ~/.asdf/asdf.sh && asdf install %s %s && asdf global %s %s", shellQuote(tool), shellQuote(versions[tool]), shellQuote(tool), shellQuote(versions[tool])),
+			After: []string{"asdf-plugin-" + tool},
+		}
+		if previous != "" {
+			c.After = append(c.After, previous)
 		}
+		cmds = append(cmds, c)
+		previous = c.Name
+	}
+	return cmds
+}
 
-		// Setup the base system
-		if err := runOrderedCommands(ctx, setup_commands, connection); err != nil {
-			ctx.Log.Error(fmt.Sprintf("Failed to run base commands: %v", err), nil)
-			return err
+// sdkInstallCmd installs a candidate with SDKMAN, at the latest version if
+// version is empty. sdk is a bash function.
+func sdkInstallCmd(candidate, version string) string {
+	return fmt.Sprintf("bash -c %s", shellQuote(strings.TrimSpace(fmt.Sprintf("source ~/.sdkman/bin/sdkman-init.sh && sdk install %s %s", candidate, version))))
+}
+
+// javaCommands installs SDKMAN, a JDK and the build tools, one after another
+// since SDKMAN shares its download directory. The tools are gradle, maven or
+// both.
+func javaCommands(javaVersion string, buildTools []string, toolVersions map[string]string) ([]CommandSpec, error) {
+	cmds := []CommandSpec{
+		{
+			Name:      "install-sdkman",
+			Cmd:       `curl -fsSL "https://get.sdkman.io?rcupdate=false" | bash && sed -i.bak 's/^sdkman_auto_answer=.*/sdkman_auto_answer=true/' ~/.sdkman/etc/config && rm -f ~/.sdkman/etc/config.bak`,
+			Condition: "[ ! -d ~/.sdkman ]",
+			After:     []string{"install-packages"},
+		},
+		{Name: "install-java", Cmd: sdkInstallCmd("java", javaVersion), After: []string{"install-sdkman"}},
+	}
+
+	var tools []string
+	for _, t := range buildTools {
+		switch t {
+		case "gradle", "maven":
+			tools = append(tools, t)
+		case "both":
+			tools = append(tools, "gradle", "maven")
+		default:
+			return nil, fmt.Errorf("unsupported javaBuildTools entry: %s", t)
+		}
+	}
+	slices.Sort(tools)
+	for _, t := range slices.Compact(tools) {
+		cmds = append(cmds, CommandSpec{Name: "install-" + t, Cmd: sdkInstallCmd(t, toolVersions[t]), After: []string{cmds[len(cmds)-1].Name}})
+	}
+	return cmds, nil
+}
+
+// proxyCmd configures the package manager to use the proxies, an empty
+// command where it would need more than the environment.
+func proxyCmd(distribution, httpProxy, httpsProxy string) string {
+	switch distribution {
+	case "fedora", "fedora-coreos", "amazonlinux2023", "rhel":
+		// dnf has a single proxy for every scheme
+		return managedBlockCmd("/etc/dnf/dnf.conf", "devenv", "proxy="+cmp.Or(httpsProxy, httpProxy), true)
+	case "ubuntu", "debian":
+		var lines []string
+		if httpProxy != "" {
+			lines = append(lines, fmt.Sprintf("Acquire::http::Proxy \"%s\";", httpProxy))
 		}
+		if httpsProxy != "" {
+			lines = append(lines, fmt.Sprintf("Acquire::https::Proxy \"%s\";", httpsProxy))
+		}
+		return sudoWriteFileCmd("/etc/apt/apt.conf.d/99proxy", strings.Join(lines, "\n"))
+	default:
+		return ""
+	}
+}
 
-		// The rest
-		if err := runIndependentCommands(ctx, extra_commands, connection); err != nil {
-			ctx.Log.Error(fmt.Sprintf("Failed to run setup commands: %v", err), nil)
-			return err
+// defaultFallbackDNS is used when no server in dnsServers answers, unless
+// dnsFallbackServers replaces it.
+var defaultFallbackDNS = []string{"1.1.1.1", "9.9.9.9"}
+
+// dnsCmd adds a resolved.conf drop-in with the servers and the search domain,
+// none if domain is empty, and restarts systemd-resolved.
+func dnsCmd(servers []string, domain string, fallback []string) string {
+	lines := []string{
+		"[Resolve]",
+		"DNS=" + strings.Join(servers, " "),
+		"FallbackDNS=" + strings.Join(fallback, " "),
+	}
+	if domain != "" {
+		lines = append(lines, "Domains="+domain)
+	}
+	return fmt.Sprintf("%s && sudo systemctl restart systemd-resolved", sudoWriteFileCmd("/etc/systemd/resolved.conf.d/99-custom.conf", strings.Join(lines, "\n")))
+}
+
+// proxyEnvCmd adds the proxy variables to every session's environment,
+// which cargo and the downloads pick them up from. pam_env reads
+// /etc/environment for SSH commands too, not only for login shells. macOS
+// has no pam_env, zsh reads /etc/zshenv for every shell instead.
+func proxyEnvCmd(distribution string, env map[string]string) string {
+	var lines []string
+	for _, k := range slices.Sorted(maps.Keys(env)) {
+		if isLinux(distribution) {
+			lines = append(lines, fmt.Sprintf("%s=%s", k, env[k]))
+		} else {
+			lines = append(lines, fmt.Sprintf("export %s=%s", k, shellQuote(env[k])))
+		}
+	}
+
+	if isLinux(distribution) {
+		return managedBlockCmd("/etc/environment", "devenv proxy", strings.Join(lines, "\n"), true)
+	}
+	return managedBlockCmd("/etc/zshenv", "devenv proxy", strings.Join(lines, "\n"), true)
+}
+
+// Installs and updates wait for another package manager run, unattended
+// upgrades or one of the extra commands, to let go of the lock rather than
+// fail. apt takes its lock with fcntl, which flock can't wait on, but it can
+// wait by itself, like dnf does.
+const (
+	aptGet     = "sudo apt-get -o DPkg::Lock::Timeout=600"
+	pacmanWait = "while [ -f /var/lib/pacman/db.lck ]; do sleep 2; done"
+)
+
+func installCmd(distribution string) (string, error) {
+	switch distribution {
+	case "fedora", "amazonlinux2023", "rhel":
+		return "sudo dnf install -y", nil
+	case "fedora-silverblue":
+		// Layered packages only show up after a reboot
+		return "sudo rpm-ostree install -y --idempotent --allow-inactive", nil
+	case "fedora-coreos":
+		// Packages go into the dev container, see devContainerCmds
+		return "sudo dnf install -y", nil
+	case "ubuntu", "debian":
+		return aptGet + " install -y", nil
+	case "arch":
+		return pacmanWait + " && sudo pacman -S --needed --noconfirm", nil
+	case "gentoo":
+		// --ask would wait for an answer that never comes
+		return "sudo emerge --noreplace --verbose", nil
+	case "macos":
+		// Homebrew refuses to run as root
+		return "brew install", nil
+	default:
+		return "", fmt.Errorf("unsupported distribution: %s", distribution)
+	}
+}
+
+func updateCmd(distribution string) (string, error) {
+	switch distribution {
+	case "fedora", "amazonlinux2023", "rhel":
+		return "sudo dnf update -y", nil
+	case "fedora-silverblue":
+		return "sudo rpm-ostree upgrade", nil
+	case "fedora-coreos":
+		return "sudo dnf update -y", nil
+	case "ubuntu", "debian":
+		return aptGet + " update && " + aptGet + " dist-upgrade -y", nil
+	case "arch":
+		return pacmanWait + " && sudo pacman -Syu --noconfirm", nil
+	case "gentoo":
+		return "sudo emerge --sync && sudo emerge -uvDN @world", nil
+	case "macos":
+		return "brew update && brew upgrade", nil
+	default:
+		return "", fmt.Errorf("unsupported distribution: %s", distribution)
+	}
+}
+
+// packageStateFile lists the packages incrementalInstallCmd has installed.
+const packageStateFile = "~/.local/state/devenv/packages"
+
+// incrementalInstallCmd installs only the packages that aren't in
+// packageStateFile yet and adds them to it.
+func incrementalInstallCmd(installCmd string, packages []string) string {
+	return fmt.Sprintf(`mkdir -p %s && touch %s && new=$(for p in %s; do grep -qxF "$p" %s || echo "$p"; done) && if [ -n "$new" ]; then %s $new && echo "$new" >> %s; fi`,
+		path.Dir(packageStateFile), packageStateFile, strings.Join(packages, " "), packageStateFile, installCmd, packageStateFile)
+}
+
+// rhelRegisterCmd registers the host with Red Hat unless it already is, then
+// enables CodeReady Linux Builder, which has the -devel packages. It uses
+// the organization's activation key if there is one, the account otherwise.
+// subscription-manager reads the password from stdin without a terminal,
+// printf is a builtin, so it never shows up in ps.
+func rhelRegisterCmd(org, activationKey, username, password string) string {
+	register := fmt.Sprintf("printf '%%s\\n' %s | sudo subscription-manager register --username %s", shellQuote(password), shellQuote(username))
+	if activationKey != "" {
+		register = fmt.Sprintf("sudo subscription-manager register --org %s --activationkey %s", shellQuote(org), shellQuote(activationKey))
+	}
+	register = conditionalCmd("! sudo subscription-manager status > /dev/null 2>&1", register)
+	return fmt.Sprintf(`%s && sudo subscription-manager repos --enable "codeready-builder-for-rhel-$(rpm -E %%rhel)-$(uname -m)-rpms"`, register)
+}
+
+// cleanCacheCmd empties the package manager caches and removes leftover
+// installer downloads.
+func cleanCacheCmd(distribution string) string {
+	var clean string
+	switch distribution {
+	case "fedora", "fedora-coreos", "amazonlinux2023", "rhel":
+		clean = "sudo dnf clean all"
+	case "fedora-silverblue":
+		clean = "sudo rpm-ostree cleanup -m"
+	case "ubuntu", "debian":
+		clean = "sudo apt-get clean && sudo apt-get autoremove -y"
+	case "arch":
+		clean = "sudo pacman -Sc --noconfirm"
+	case "gentoo":
+		clean = "sudo rm -rf /var/cache/distfiles/*"
+	case "macos":
+		clean = "brew cleanup"
+	}
+
+	return fmt.Sprintf("%s && rm -rf ~/tmp-install-*", clean)
+}
+
+// vaultInstallCmd adds HashiCorp's package repository and installs the vault
+// CLI from it. apt reads the armored key as is, no gpg needed.
+func vaultInstallCmd(distribution string) (string, error) {
+	switch distribution {
+	case "fedora", "fedora-coreos":
+		return "sudo dnf config-manager addrepo --overwrite --from-repofile=https://rpm.releases.hashicorp.com/fedora/hashicorp.repo && sudo dnf install -y vault", nil
+	case "rhel":
+		return "sudo dnf config-manager --add-repo https://rpm.releases.hashicorp.com/RHEL/hashicorp.repo && sudo dnf install -y vault", nil
+	case "amazonlinux2023":
+		return "sudo dnf config-manager --add-repo https://rpm.releases.hashicorp.com/AmazonLinux/hashicorp.repo && sudo dnf install -y vault", nil
+	case "ubuntu", "debian":
+		return `curl -fsSL https://apt.releases.hashicorp.com/gpg | sudo tee /usr/share/keyrings/hashicorp-archive-keyring.asc > /dev/null && echo "deb [signed-by=/usr/share/keyrings/hashicorp-archive-keyring.asc] https://apt.releases.hashicorp.com $(. /etc/os-release && echo $VERSION_CODENAME) main" | sudo tee /etc/apt/sources.list.d/hashicorp.list > /dev/null && sudo apt-get update && sudo apt-get install -y vault`, nil
+	case "macos":
+		return "brew tap hashicorp/tap && brew install hashicorp/tap/vault", nil
+	default:
+		return "", fmt.Errorf("installVault is not supported on %s", distribution)
+	}
+}
+
+// vaultAgentConfig authenticates with the AppRole whose IDs are in
+// ~/.config/vault and keeps the token in ~/.vault-token, where the vault CLI
+// looks for it. The agent doesn't expand ~, configure-vault-agent does. Run it
+// with `vault agent -config ~/.config/vault/vault-agent.hcl`.
+const vaultAgentConfig = `pid_file = "/tmp/vault-agent.pid"
+
+auto_auth {
+  method "approle" {
+    config = {
+      role_id_file_path                   = "~/.config/vault/role-id"
+      secret_id_file_path                 = "~/.config/vault/secret-id"
+      remove_secret_id_file_after_reading = false
+    }
+  }
+
+  sink "file" {
+    config = {
+      path = "~/.vault-token"
+    }
+  }
+}`
+
+// updateTimeout is how long updating and installing packages may take, zero
+// for Pulumi's default. Gentoo builds everything from source.
+func updateTimeout(distribution string) time.Duration {
+	if distribution == "gentoo" {
+		return 12 * time.Hour
+	}
+	return 0
+}
+
+func isLinux(distribution string) bool {
+	return distribution != "macos"
+}
+
+// isOSTree reports whether the distribution has an immutable, rpm-ostree
+// managed root filesystem.
+func isOSTree(distribution string) bool {
+	return distribution == "fedora-silverblue"
+}
+
+// usesDevContainer reports whether the distribution is set up inside a
+// distrobox rather than through the host's package manager.
+func usesDevContainer(distribution string) bool {
+	return distribution == "fedora-coreos"
+}
+
+const (
+	devContainerName  = "dev"
+	devContainerImage = "registry.fedoraproject.org/fedora-toolbox:latest"
+)
+
+// devContainerCmds returns the host commands that create the dev container.
+// distrobox is layered with rpm-ostree, so installing it means a reboot.
+func devContainerCmds(image string) []CommandSpec {
+	return []CommandSpec{
+		{Name: "install-distrobox", Cmd: "sudo rpm-ostree install -y --idempotent distrobox", Condition: "! command -v distrobox > /dev/null", RequiresReboot: true},
+		{Name: "pull-dev-image", Cmd: fmt.Sprintf("podman pull %s", image)},
+		{Name: "create-distrobox", Cmd: fmt.Sprintf("distrobox create --yes --name %s --image %s", devContainerName, image), Condition: fmt.Sprintf("! podman container exists %s", devContainerName)},
+	}
+}
+
+// systemEnvCmd exports the variables for every login shell from
+// /etc/profile.d, which all the Linux distributions source.
+func systemEnvCmd(env map[string]string) string {
+	var lines []string
+	for _, k := range slices.Sorted(maps.Keys(env)) {
+		lines = append(lines, fmt.Sprintf("export %s=%s", k, shellQuote(env[k])))
+	}
+
+	return sudoWriteFileCmd("/etc/profile.d/99-devenv.sh", strings.Join(lines, "\n"))
+}
+
+// neovimAppImageCmd downloads the Neovim AppImage for a release tag (or
+// "nightly") and links it as ~/.local/bin/nvim. There are amd64 and arm64
+// AppImages since v0.10.4, before that a single amd64 nvim.appimage.
+func neovimAppImageCmd(version, arch string) (string, error) {
+	asset := fmt.Sprintf("nvim-linux-%s.appimage", arch)
+	if arch == "amd64" {
+		asset = "nvim-linux-x86_64.appimage"
+	}
+
+	if version != "nightly" {
+		var major, minor, patch int
+		if _, err := fmt.Sscanf(version, "v%d.%d.%d", &major, &minor, &patch); err != nil || fmt.Sprintf("v%d.%d.%d", major, minor, patch) != version {
+			return "", fmt.Errorf("unsupported neovimVersion: %s, expected a release tag like v0.11.0 or nightly", version)
+		}
+		if major == 0 && (minor < 10 || minor == 10 && patch < 4) {
+			if arch != "amd64" {
+				return "", fmt.Errorf("neovim %s has no %s AppImage", version, arch)
+			}
+			asset = "nvim.appimage"
+		}
+	}
+
+	url := fmt.Sprintf("https://github.com/neovim/neovim/releases/download/%s/%s", version, asset)
+	appImage := fmt.Sprintf("~/.local/share/nvim/nvim-%s.appimage", version)
+
+	return fmt.Sprintf("mkdir -p ~/.local/share/nvim ~/.local/bin && curl -fLo %s %s && chmod +x %s && ln -sf %s ~/.local/bin/nvim", appImage, url, appImage, appImage), nil
+}
+
+// isSafeName reports whether name is non-empty and only has letters, digits,
+// underscores and hyphens, so it can go into file and resource names as is.
+func isSafeName(name string) bool {
+	return name != "" && strings.Trim(name, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789_-") == ""
+}
+
+func udevRuleCmd(rule UdevRule) (string, error) {
+	if !isSafeName(rule.Name) {
+		return "", fmt.Errorf("invalid udev rule name: %s", rule.Name)
+	}
+	file := fmt.Sprintf("/etc/udev/rules.d/%s.rules", rule.Name)
+	return sudoWriteFileCmd(file, rule.Content), nil
+}
+
+// GitConfig holds the ~/.gitconfig settings, empty fields are left alone.
+type GitConfig struct {
+	UserName          string `json:"userName"`
+	UserEmail         string `json:"userEmail"`
+	CoreEditor        string `json:"coreEditor"`
+	CorePager         string `json:"corePager"`
+	DiffTool          string `json:"diffTool"`
+	MergeTool         string `json:"mergeTool"`
+	PushDefault       string `json:"pushDefault"`
+	PullRebase        string `json:"pullRebase"`
+	InitDefaultBranch string `json:"initDefaultBranch"`
+}
+
+func generateGitConfigCmd(cfg GitConfig) string {
+	settings := []struct {
+		key   string
+		value string
+	}{
+		{"user.name", cfg.UserName},
+		{"user.email", cfg.UserEmail},
+		{"core.editor", cfg.CoreEditor},
+		{"core.pager", cfg.CorePager},
+		{"diff.tool", cfg.DiffTool},
+		{"merge.tool", cfg.MergeTool},
+		{"push.default", cfg.PushDefault},
+		{"pull.rebase", cfg.PullRebase},
+		{"init.defaultBranch", cfg.InitDefaultBranch},
+	}
+
+	var cmds []string
+	for _, s := range settings {
+		if s.value != "" {
+			cmds = append(cmds, fmt.Sprintf("git config --global %s %s", s.key, shellQuote(s.value)))
+		}
+	}
+	return strings.Join(cmds, " && ")
+}
+
+// modeSkips lists the setup commands each mode leaves out, "full" runs them
+// all. minimal skips everything packages-only does.
+var modeSkips = map[string][]string{
+	"full":          {},
+	"packages-only": {"setup-config", "setup-hacks", "write-ssh-agent-service", "enable-ssh-agent-service", "set-zlogin", "use-zsh"},
+	"minimal":       {"setup-config", "setup-hacks", "write-ssh-agent-service", "enable-ssh-agent-service", "set-zlogin", "use-zsh", "install-yay", "install-aur-packages", "install-cargo", "warm-cargo-cache", "install-cargo-packages", "install-nix", "setup-nix-flake"},
+}
+
+// filterCommandsForMode drops the commands the mode skips.
+func filterCommandsForMode(commands []CommandSpec, mode string) ([]CommandSpec, error) {
+	skips, ok := modeSkips[mode]
+	if !ok {
+		return nil, fmt.Errorf("unsupported mode: %s", mode)
+	}
+	return slices.DeleteFunc(commands, func(c CommandSpec) bool { return slices.Contains(skips, c.Name) }), nil
+}
+
+// withoutOrphans drops the commands that have to run after one that isn't
+// run, or after such a command in turn. kept lists the commands that are.
+func withoutOrphans(commands []CommandSpec, kept []CommandSpec) []CommandSpec {
+	known := map[string]bool{}
+	for _, c := range kept {
+		known[c.Name] = true
+	}
+
+	var result []CommandSpec
+	for _, c := range commands {
+		if slices.ContainsFunc(c.After, func(name string) bool { return !known[name] }) {
+			continue
+		}
+		known[c.Name] = true
+		result = append(result, c)
+	}
+	return result
+}
+
+// deduplicateCommands concatenates the groups and fails on names that are
+// used more than once, which Pulumi would only reject halfway through
+// creating the resources. Names compare case-insensitively, with spaces as
+// hyphens.
+func deduplicateCommands(groups ...[]CommandSpec) ([]CommandSpec, error) {
+	commands := slices.Concat(groups...)
+
+	seen := map[string]bool{}
+	var duplicates []string
+	for _, c := range commands {
+		name := strings.ReplaceAll(strings.ToLower(c.Name), " ", "-")
+		if seen[name] && !slices.Contains(duplicates, c.Name) {
+			duplicates = append(duplicates, c.Name)
+		}
+		seen[name] = true
+	}
+
+	if len(duplicates) > 0 {
+		return nil, fmt.Errorf("duplicate command names: %s", strings.Join(duplicates, ", "))
+	}
+	return commands, nil
+}
+
+// insertBefore inserts extra in front of the named command, or appends them
+// if there is no such command.
+func insertBefore(commands []CommandSpec, name string, extra ...CommandSpec) []CommandSpec {
+	i := slices.IndexFunc(commands, func(c CommandSpec) bool { return c.Name == name })
+	if i < 0 {
+		return append(commands, extra...)
+	}
+	return slices.Insert(commands, i, extra...)
+}
+
+const sshAgentUnit = `[Unit]
+Description=SSH key agent
+
+[Service]
+Type=simple
+Environment=SSH_AUTH_SOCK=%t/ssh-agent.socket
+ExecStart=/usr/bin/ssh-agent -D -a $SSH_AUTH_SOCK
+
+[Install]
+WantedBy=default.target`
+
+// cronToOnCalendar turns a five field cron expression into a systemd calendar
+// event. Fields may be *, numbers, ranges, lists and steps. Anything that
+// isn't five fields is taken to be a calendar event already, like "daily".
+func cronToOnCalendar(expr string) (string, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return expr, nil
+	}
+
+	// Cron's week starts on Sunday and systemd's on Monday, so weekday ranges
+	// are spelled out as lists rather than mapped to a systemd range.
+	days := []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat", "Sun"}
+	convert := func(field string, first, last int, weekday bool) (string, error) {
+		if field == "*" {
+			return "*", nil
+		}
+
+		var items []string
+		for _, item := range strings.Split(field, ",") {
+			item, step, hasStep := strings.Cut(item, "/")
+			if item == "*" && hasStep {
+				item = strconv.Itoa(first)
+			}
+			if weekday && hasStep {
+				return "", fmt.Errorf("steps aren't supported for weekdays: %s", field)
+			}
+			if n, err := strconv.Atoi(step); hasStep && (err != nil || n < 1) {
+				return "", fmt.Errorf("invalid cron field: %s", field)
+			}
+
+			from, to, isRange := strings.Cut(item, "-")
+			if !isRange {
+				to = from
+			}
+			start, err := strconv.Atoi(from)
+			if err != nil || start < first {
+				return "", fmt.Errorf("invalid cron field: %s", field)
+			}
+			end, err := strconv.Atoi(to)
+			if err != nil || end < start || end > last {
+				return "", fmt.Errorf("invalid cron field: %s", field)
+			}
+
+			if weekday {
+				for v := start; v <= end; v++ {
+					if !slices.Contains(items, days[v]) {
+						items = append(items, days[v])
+					}
+				}
+				continue
+			}
+
+			if isRange {
+				item = from + ".." + to
+			}
+			if hasStep {
+				item += "/" + step
+			}
+			items = append(items, item)
+		}
+		return strings.Join(items, ","), nil
+	}
+
+	minute, err := convert(fields[0], 0, 59, false)
+	if err != nil {
+		return "", err
+	}
+	hour, err := convert(fields[1], 0, 23, false)
+	if err != nil {
+		return "", err
+	}
+	dom, err := convert(fields[2], 1, 31, false)
+	if err != nil {
+		return "", err
+	}
+	month, err := convert(fields[3], 1, 12, false)
+	if err != nil {
+		return "", err
+	}
+	dow, err := convert(fields[4], 0, len(days)-1, true)
+	if err != nil {
+		return "", err
+	}
+
+	event := fmt.Sprintf("*-%s-%s %s:%s:00", month, dom, hour, minute)
+	if dow != "*" {
+		event = dow + " " + event
+	}
+	return event, nil
+}
+
+// autoUpdateUnits returns the user service that runs pulumi up for the stack
+// in dir, with the given environment, and its timer.
+func autoUpdateUnits(dir, pulumiPath, stack, onCalendar string, env map[string]string) (string, string) {
+	// systemd expands specifiers everywhere, quotes and escapes in quoted
+	// values and variables in ExecStart
+	specifiers := strings.NewReplacer("%", "%%").Replace
+	quote := func(v string) string {
+		return `"` + strings.NewReplacer("%", "%%", `\`, `\\`, `"`, `\"`).Replace(v) + `"`
+	}
+	execQuote := func(v string) string {
+		return strings.ReplaceAll(quote(v), "$", "$$")
+	}
+
+	var environment strings.Builder
+	for _, k := range slices.Sorted(maps.Keys(env)) {
+		fmt.Fprintf(&environment, "Environment=%s\n", quote(k+"="+env[k]))
+	}
+
+	service := fmt.Sprintf(`[Unit]
+Description=Re-provision the machine with pulumi up
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=oneshot
+WorkingDirectory=%s
+%sExecStart=%s up --yes --skip-preview --stack %s
+TimeoutStartSec=2h`, specifiers(dir), environment.String(), execQuote(pulumiPath), execQuote(stack))
+
+	timer := fmt.Sprintf(`[Unit]
+Description=Re-provision the machine on a schedule
+
+[Timer]
+OnCalendar=%s
+RandomizedDelaySec=15m
+Persistent=true
+
+[Install]
+WantedBy=timers.target`, onCalendar)
+
+	return service, timer
+}
+
+// scheduleAutoUpdate installs a user timer that runs pulumi up for this
+// stack again on the machine running it now, where the project, the login
+// and the SSH key already are.
+func scheduleAutoUpdate(ctx *pulumi.Context, cron string) error {
+	onCalendar, err := cronToOnCalendar(cron)
+	if err != nil {
+		return fmt.Errorf("failed to parse updateCron: %w", err)
+	}
+
+	if _, err := exec.LookPath("systemctl"); err != nil {
+		return errors.New("scheduleAutoUpdate needs systemd on the machine running pulumi up")
+	}
+	pulumiPath, err := exec.LookPath("pulumi")
+	if err != nil {
+		return fmt.Errorf("scheduleAutoUpdate needs pulumi on PATH: %w", err)
+	}
+	pulumiPath, err = filepath.Abs(pulumiPath)
+	if err != nil {
+		return err
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	// The timer can't prompt for the passphrase and shouldn't store it
+	if os.Getenv("PULUMI_CONFIG_PASSPHRASE") != "" && os.Getenv("PULUMI_CONFIG_PASSPHRASE_FILE") == "" {
+		return errors.New("scheduleAutoUpdate needs PULUMI_CONFIG_PASSPHRASE_FILE instead of PULUMI_CONFIG_PASSPHRASE")
+	}
+
+	// PATH has to find go and the plugins, the rest picks the same backend
+	env := map[string]string{"PATH": os.Getenv("PATH")}
+	for _, k := range []string{"PULUMI_HOME", "PULUMI_BACKEND_URL", "PULUMI_CONFIG_PASSPHRASE_FILE"} {
+		if v := os.Getenv(k); v != "" {
+			if k != "PULUMI_BACKEND_URL" {
+				if v, err = filepath.Abs(v); err != nil {
+					return err
+				}
+			}
+			env[k] = v
+		}
+	}
+
+	service, timer := autoUpdateUnits(dir, pulumiPath, ctx.Stack(), onCalendar, env)
+	_, err = local.NewCommand(ctx, "schedule-auto-update", &local.CommandArgs{
+		Create: pulumi.String(strings.Join([]string{
+			writeFileCmd("~/.config/systemd/user/devenv-update.service", service),
+			writeFileCmd("~/.config/systemd/user/devenv-update.timer", timer),
+			"systemctl --user daemon-reload",
+			"systemctl --user enable --now devenv-update.timer",
+		}, " && ")),
+		Delete: pulumi.String("systemctl --user disable --now devenv-update.timer; rm -f ~/.config/systemd/user/devenv-update.service ~/.config/systemd/user/devenv-update.timer && systemctl --user daemon-reload"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to schedule auto update: %w", err)
+	}
+	return nil
+}
+
+// cargoMoldConfig links with mold through clang, both are common packages,
+// for the host's target.
+func cargoMoldConfig(arch string) string {
+	return fmt.Sprintf(`[target.%s-unknown-linux-gnu]
+linker = "clang"
+rustflags = ["-C", "link-arg=-fuse-ld=mold"]`, unameArch(arch))
+}
+
+const coredumpSysctl = "kernel.core_pattern = |/usr/lib/systemd/systemd-coredump %P %u %g %s %t %c %h"
+
+const bpfSysctl = `kernel.unprivileged_bpf_disabled=0
+kernel.perf_event_paranoid=-1`
+
+// gitSigningCmd enables commit signing with a GPG key id or an SSH public key
+// path. publicKey, an armored GPG public key, is imported first when set.
+func gitSigningCmd(key, method, publicKey string) (string, error) {
+	var format string
+	switch method {
+	case "gpg":
+		format = "openpgp"
+	case "ssh":
+		format = "ssh"
+	default:
+		return "", fmt.Errorf("unsupported git signing method: %s", method)
+	}
+
+	cmds := []string{
+		fmt.Sprintf("git config --global user.signingkey %s", shellQuote(key)),
+		fmt.Sprintf("git config --global gpg.format %s", format),
+		"git config --global commit.gpgsign true",
+	}
+	if method == "gpg" && publicKey != "" {
+		cmds = slices.Insert(cmds, 0, fmt.Sprintf("echo %s | gpg --batch --import", shellQuote(publicKey)))
+	}
+	return strings.Join(cmds, " && "), nil
+}
+
+// yayInstallCmd builds the yay AUR helper from source, makepkg pulls in its
+// build dependencies.
+const yayInstallCmd = "rm -rf /tmp/yay && git clone https://aur.archlinux.org/yay.git /tmp/yay && cd /tmp/yay && makepkg -si --noconfirm && rm -rf /tmp/yay"
+
+// defaultLimits are keyed by "<type> <item>" as in limits.conf
+var defaultLimits = map[string]string{
+	"soft nofile": "1048576",
+	"hard nofile": "1048576",
+	"soft nproc":  "65536",
+	"hard nproc":  "65536",
+}
+
+// limitsCmd writes the default limits for all users, overridden by custom.
+func limitsCmd(custom map[string]string) string {
+	limits := maps.Clone(defaultLimits)
+	maps.Copy(limits, custom)
+
+	var lines []string
+	for _, k := range slices.Sorted(maps.Keys(limits)) {
+		lines = append(lines, fmt.Sprintf("* %s %s", k, limits[k]))
+	}
+	return sudoWriteFileCmd("/etc/security/limits.d/99-devenv.conf", strings.Join(lines, "\n"))
+}
+
+// crossGCCPackage returns the package with the C cross compiler for a Rust
+// target, "" for targets that aren't linux-gnu ones, that hostArch runs
+// natively or that the distribution doesn't package a compiler for.
+func crossGCCPackage(distribution, hostArch, target string) string {
+	arch, _, _ := strings.Cut(target, "-")
+	if !strings.Contains(target, "-linux-gnu") || arch == unameArch(hostArch) {
+		return ""
+	}
+
+	switch {
+	case strings.HasPrefix(arch, "arm"):
+		arch = "arm"
+	case strings.HasPrefix(arch, "riscv64"):
+		arch = "riscv64"
+	}
+
+	switch distribution {
+	case "ubuntu", "debian":
+		if arch == "arm" {
+			return "gcc-arm-linux-gnueabihf"
+		}
+		return fmt.Sprintf("gcc-%s-linux-gnu", strings.ReplaceAll(arch, "_", "-"))
+	case "fedora":
+		return fmt.Sprintf("gcc-%s-linux-gnu", arch)
+	case "arch":
+		if arch == "aarch64" || arch == "riscv64" {
+			return fmt.Sprintf("%s-linux-gnu-gcc", arch)
+		}
+	}
+	return ""
+}
+
+// cpuGovernorCmd sets every CPU's frequency governor, now and through
+// systemd-tmpfiles on every boot.
+func cpuGovernorCmd(governor string) (string, error) {
+	if !slices.Contains([]string{"performance", "ondemand", "powersave"}, governor) {
+		return "", fmt.Errorf("unsupported cpuGovernor: %s", governor)
+	}
+
+	files := "/sys/devices/system/cpu/cpu*/cpufreq/scaling_governor"
+	return fmt.Sprintf("echo %s | sudo tee %s > /dev/null && %s", governor, files,
+		sudoWriteFileCmd("/etc/tmpfiles.d/99-cpu-governor.conf", fmt.Sprintf("w %s - - - - %s", files, governor))), nil
+}
+
+// thpCmd sets the transparent hugepage mode, and defrag to the same, now and
+// through systemd-tmpfiles on every boot.
+func thpCmd(mode string) (string, error) {
+	if !slices.Contains([]string{"always", "madvise", "never"}, mode) {
+		return "", fmt.Errorf("unsupported thpMode: %s", mode)
+	}
+
+	var cmds, tmpfiles []string
+	for _, setting := range []string{"enabled", "defrag"} {
+		file := "/sys/kernel/mm/transparent_hugepage/" + setting
+		cmds = append(cmds, fmt.Sprintf("echo %s | sudo tee %s > /dev/null", mode, file))
+		tmpfiles = append(tmpfiles, fmt.Sprintf("w %s - - - - %s", file, mode))
+	}
+	cmds = append(cmds, sudoWriteFileCmd("/etc/tmpfiles.d/99-thp.conf", strings.Join(tmpfiles, "\n")))
+	return strings.Join(cmds, " && "), nil
+}
+
+// oomConfigCmd writes a drop-in setting OOMScoreAdjust for each systemd unit,
+// "user@" covers every user session. Units pick it up when they restart,
+// after the systemd-daemon-reload handler.
+func oomConfigCmd(adjustments map[string]int) (string, error) {
+	var cmds []string
+	for _, unit := range slices.Sorted(maps.Keys(adjustments)) {
+		score := adjustments[unit]
+		if score < -1000 || score > 1000 {
+			return "", fmt.Errorf("OOM score adjustment for '%s' must be between -1000 and 1000, got %d", unit, score)
+		}
+
+		file := fmt.Sprintf("/etc/systemd/system/%s.service.d/99-oom.conf", unit)
+		cmds = append(cmds, sudoWriteFileCmd(file, fmt.Sprintf("[Service]\nOOMScoreAdjust=%d", score)))
+	}
+	return strings.Join(cmds, " && "), nil
+}
+
+// jsManagerInstallCmd installs the JavaScript toolchain manager without
+// touching the shell init files, ~/.zlogin is managed by set-zlogin.
+func jsManagerInstallCmd(manager string) (string, error) {
+	switch manager {
+	case "volta":
+		return "curl -fsSL https://get.volta.sh | bash -s -- --skip-setup", nil
+	case "fnm":
+		return "curl -fsSL https://fnm.vercel.app/install | bash -s -- --skip-shell", nil
+	case "nvm":
+		return "curl -fsSL https://raw.githubusercontent.com/nvm-sh/nvm/v0.40.3/install.sh | PROFILE=/dev/null bash", nil
+	case "", "none":
+		return "", nil
+	default:
+		return "", fmt.Errorf("unsupported JavaScript toolchain manager: %s", manager)
+	}
+}
+
+// shellInitForJSManager returns the shell init snippet putting the manager's
+// node on PATH, nvm has no fish support.
+func shellInitForJSManager(manager, shell string) string {
+	fish := shell == "fish"
+
+	switch manager {
+	case "volta":
+		if fish {
+			return "set -gx VOLTA_HOME \"$HOME/.volta\"\nfish_add_path $VOLTA_HOME/bin"
+		}
+		return "export VOLTA_HOME=\"$HOME/.volta\"\nexport PATH=\"$VOLTA_HOME/bin:$PATH\""
+	case "fnm":
+		if fish {
+			return "~/.local/share/fnm/fnm env --use-on-cd --shell fish | source"
+		}
+		return fmt.Sprintf("eval \"$(~/.local/share/fnm/fnm env --use-on-cd --shell %s)\"", shell)
+	case "nvm":
+		if fish {
+			return ""
+		}
+		return "export NVM_DIR=\"$HOME/.nvm\"\n[ -s \"$NVM_DIR/nvm.sh\" ] && . \"$NVM_DIR/nvm.sh\""
+	default:
+		return ""
+	}
+}
+
+// warmCargoManifest depends on crates that most crates.io binaries pull in,
+// so cargo fetch primes the registry index and download cache with them.
+const warmCargoManifest = `[package]
+name = "warm-cargo-cache"
+version = "0.0.0"
+edition = "2021"
+
+[dependencies]
+clap = { version = "4", features = ["derive"] }
+regex = "1"
+serde = { version = "1", features = ["derive"] }
+serde_json = "1"
+syn = { version = "2", features = ["full"] }`
+
+// warmCargoCacheCmd runs cargo fetch on warmCargoManifest. The directory
+// matches the cleanup-cache pattern.
+func warmCargoCacheCmd() string {
+	dir := "~/tmp-install-cargo-cache"
+	return fmt.Sprintf("%s && %s && ~/.cargo/bin/cargo fetch --manifest-path %s/Cargo.toml && rm -rf %s",
+		writeFileCmd(dir+"/Cargo.toml", warmCargoManifest), writeFileCmd(dir+"/src/lib.rs", ""), dir, dir)
+}
+
+// nixInstallCmd uses the Determinate Systems installer, which enables flakes
+// and undoes itself with /nix/nix-installer uninstall.
+const nixInstallCmd = "curl --proto '=https' --tlsv1.2 -sSfL https://install.determinate.systems/nix | sh -s -- install --no-confirm"
+
+// nixDevelopCmd builds the flake's dev shell. Saving it as a profile keeps it
+// from being garbage collected, `nix develop ~/.local/state/nix/profiles/devenv`
+// enters it without fetching the flake again.
+func nixDevelopCmd(flake string) string {
+	return fmt.Sprintf("/nix/var/nix/profiles/default/bin/nix develop %s --profile ~/.local/state/nix/profiles/devenv --command true", shellQuote(flake))
+}
+
+// ohMyZshInstallCmd replaces ~/.zshrc with oh-my-zsh's template, which
+// keeps the old one as ~/.zshrc.pre-oh-my-zsh.
+const ohMyZshInstallCmd = `RUNZSH=no CHSH=no sh -c "$(curl -fsSL https://raw.githubusercontent.com/ohmyzsh/ohmyzsh/master/tools/install.sh)" "" --unattended`
+
+// zshThemeCmd sets ZSH_THEME in the oh-my-zsh ~/.zshrc.
+func zshThemeCmd(theme string) string {
+	if theme == "powerlevel10k" {
+		theme = "powerlevel10k/powerlevel10k"
+	}
+	line := fmt.Sprintf("ZSH_THEME=\"%s\"", theme)
+	return fmt.Sprintf("sed -i.bak %s ~/.zshrc && rm -f ~/.zshrc.bak", shellQuote(fmt.Sprintf("s|^ZSH_THEME=.*|%s|", line)))
+}
+
+const miniforgeInstallCmd = `curl -fsSLo /tmp/miniforge.sh "https://github.com/conda-forge/miniforge/releases/latest/download/Miniforge3-$(uname)-$(uname -m).sh" && bash /tmp/miniforge.sh -b -p ~/miniforge3 && rm /tmp/miniforge.sh`
+
+const fail2banSSHJail = `[sshd]
+enabled = true
+maxretry = 3
+bantime = 1h`
+
+// shellQuote single-quotes s so the remote shell passes it through verbatim.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// writeFileCmd returns a command that writes content to a file owned by the
+// SSH user, creating its parent directory if needed.
+func writeFileCmd(file, content string) string {
+	return fmt.Sprintf("mkdir -p %s && printf '%%s\\n' %s > %s", path.Dir(file), shellQuote(content), file)
+}
+
+// managedBlockCmd returns a command that replaces the block between the
+// "# BEGIN marker" and "# END marker" lines in file with content, leaving the
+// rest of the file alone.
+func managedBlockCmd(file, marker, content string, sudo bool) string {
+	prefix := ""
+	if sudo {
+		prefix = "sudo "
+	}
+
+	block := shellQuote(fmt.Sprintf("# BEGIN %s\n%s\n# END %s", marker, content, marker))
+	return fmt.Sprintf("%smkdir -p %s && %stouch %s && %ssed -i.bak '/^# BEGIN %s$/,/^# END %s$/d' %s && %srm -f %s.bak && printf '%%s\\n' %s | %stee -a %s > /dev/null",
+		prefix, path.Dir(file), prefix, file, prefix, marker, marker, file, prefix, file, block, prefix, file)
+}
+
+// hostsCmd replaces the devenv entries block of /etc/hosts with entries, IP
+// addresses to hostnames. Several hostnames can share an address, separated
+// by spaces.
+func hostsCmd(entries map[string]string) (string, error) {
+	var lines []string
+	for _, ip := range slices.Sorted(maps.Keys(entries)) {
+		if net.ParseIP(ip) == nil {
+			return "", fmt.Errorf("invalid IP address in hostsEntries: %s", ip)
+		}
+		lines = append(lines, fmt.Sprintf("%s %s", ip, entries[ip]))
+	}
+	return managedBlockCmd("/etc/hosts", "devenv entries", strings.Join(lines, "\n"), true), nil
+}
+
+// sudoWriteFileCmd returns a command that writes content to a root-owned file,
+// creating its parent directory if needed.
+func sudoWriteFileCmd(file, content string) string {
+	return fmt.Sprintf("sudo mkdir -p %s && printf '%%s\\n' %s | sudo tee %s > /dev/null", path.Dir(file), shellQuote(content), file)
+}
+
+// gnupgPackage returns the distribution's name for GnuPG 2, most call it
+// gnupg2.
+func gnupgPackage(distribution string) string {
+	switch distribution {
+	case "arch", "gentoo", "macos":
+		return "gnupg"
+	default:
+		return "gnupg2"
+	}
+}
+
+// unavailablePackages lists common packages that the distribution
+// doesn't provide.
+func unavailablePackages(distribution string) []string {
+	switch distribution {
+	case "macos":
+		return []string{"bpftrace", "clang", "gdb", "sysstat"}
+	case "amazonlinux2023":
+		// Not packaged for AL2023 and EPEL doesn't support it
+		return []string{"htop", "lnav", "mold"}
+	case "rhel":
+		// Only in EPEL
+		return []string{"htop", "lnav", "mold"}
+	default:
+		return []string{}
+	}
+}
+
+// withoutPackages removes the excluded names from a space separated package list.
+func withoutPackages(packages string, exclude []string) string {
+	var kept []string
+	for _, p := range strings.Fields(packages) {
+		if !slices.Contains(exclude, p) {
+			kept = append(kept, p)
+		}
+	}
+	return strings.Join(kept, " ")
+}
+
+// zloginCmd writes ~/.zlogin with the PATH setup first, then the given
+// lines and the starship prompt last, unless a zsh theme draws the prompt.
+func zloginCmd(lines []string, starship bool) string {
+	content := append([]string{"path+=(~/.local/bin ~/.cargo/bin $path)"}, lines...)
+	if starship {
+		content = append(content, "eval \"$(starship init zsh)\"")
+	}
+	return writeFileCmd("~/.zlogin", strings.Join(content, "\n\n"))
+}
+
+// defaultZshOptions apply when zshOptions isn't set. The history options
+// come from zshHistory.
+var defaultZshOptions = []string{"AUTO_CD", "EXTENDED_GLOB", "INTERACTIVE_COMMENTS"}
+
+// zshOptionsLines returns a setopt line per option. Option names are letters
+// and underscores, zsh ignores case and underscores in them.
+func zshOptionsLines(options []string) (string, error) {
+	var lines []string
+	for _, o := range options {
+		if o == "" || strings.Trim(strings.ToUpper(o), "ABCDEFGHIJKLMNOPQRSTUVWXYZ_") != "" {
+			return "", fmt.Errorf("invalid zsh option: %s", o)
+		}
+		lines = append(lines, "setopt "+o)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// zshHistory returns the ~/.zlogin lines for the history settings. dups is
+// "erase" to keep only the newest of duplicate lines, "ignore" to skip
+// consecutive ones or "keep".
+func zshHistory(size int, file, dups string) (string, error) {
+	lines := []string{
+		fmt.Sprintf("HISTFILE=%s", file),
+		fmt.Sprintf("HISTSIZE=%d", size),
+		fmt.Sprintf("SAVEHIST=%d", size),
+	}
+
+	switch dups {
+	case "erase":
+		lines = append(lines, "setopt HIST_IGNORE_ALL_DUPS HIST_SAVE_NO_DUPS")
+	case "ignore":
+		lines = append(lines, "setopt HIST_IGNORE_DUPS")
+	case "keep":
+	default:
+		return "", fmt.Errorf("unsupported zshHistDups: %s", dups)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// SSHConfigEntry is a Host block of ~/.ssh/config, empty fields are left out.
+type SSHConfigEntry struct {
+	Host         string            `json:"host"`
+	HostName     string            `json:"hostName"`
+	User         string            `json:"user"`
+	Port         int               `json:"port"`
+	IdentityFile string            `json:"identityFile"`
+	ProxyJump    string            `json:"proxyJump"`
+	Options      map[string]string `json:"options"`
+}
+
+// sshClientConfig returns the raw config followed by a Host block for each
+// entry.
+func sshClientConfig(raw string, entries []SSHConfigEntry) string {
+	var blocks []string
+	if raw = strings.TrimSpace(raw); raw != "" {
+		blocks = append(blocks, raw)
+	}
+
+	for _, e := range entries {
+		lines := []string{"Host " + e.Host}
+		for _, o := range []struct {
+			key   string
+			value string
+		}{
+			{"HostName", e.HostName},
+			{"User", e.User},
+			{"IdentityFile", e.IdentityFile},
+			{"ProxyJump", e.ProxyJump},
+		} {
+			if o.value != "" {
+				lines = append(lines, fmt.Sprintf("    %s %s", o.key, o.value))
+			}
+		}
+		if e.Port != 0 {
+			lines = append(lines, fmt.Sprintf("    Port %d", e.Port))
+		}
+		for _, k := range slices.Sorted(maps.Keys(e.Options)) {
+			lines = append(lines, fmt.Sprintf("    %s %s", k, e.Options[k]))
+		}
+		blocks = append(blocks, strings.Join(lines, "\n"))
+	}
+	return strings.Join(blocks, "\n\n")
+}
+
+// authorizedKeysCmd adds the keys to ~/.ssh/authorized_keys, skipping any that
+// are already there.
+func authorizedKeysCmd(keys []string) string {
+	cmds := []string{"mkdir -p -m 700 ~/.ssh && touch ~/.ssh/authorized_keys && chmod 600 ~/.ssh/authorized_keys"}
+	for _, key := range keys {
+		key = shellQuote(strings.TrimSpace(key))
+		cmds = append(cmds, fmt.Sprintf("(grep -qxF %s ~/.ssh/authorized_keys || printf '%%s\\n' %s >> ~/.ssh/authorized_keys)", key, key))
+	}
+	return strings.Join(cmds, " && ")
+}
+
+func secretsCmd(secrets map[string]string) string {
+	var lines []string
+	for _, k := range slices.Sorted(maps.Keys(secrets)) {
+		lines = append(lines, fmt.Sprintf("export %s=%s", k, shellQuote(secrets[k])))
+	}
+
+	return fmt.Sprintf("umask 077 && %s && chmod 600 ~/.secrets.sh", writeFileCmd("~/.secrets.sh", strings.Join(lines, "\n")))
+}
+
+// npmrcCmd writes ~/.npmrc, which may hold auth tokens, readable only by the
+// user.
+func npmrcCmd(settings map[string]string) string {
+	var lines []string
+	for _, k := range slices.Sorted(maps.Keys(settings)) {
+		lines = append(lines, fmt.Sprintf("%s=%s", k, settings[k]))
+	}
+
+	return fmt.Sprintf("umask 077 && %s && chmod 600 ~/.npmrc", writeFileCmd("~/.npmrc", strings.Join(lines, "\n")))
+}
+
+// updateSchedules are the values computeUpdateTrigger accepts.
+var updateSchedules = []string{"always", "daily", "weekly", "never"}
+
+// computeUpdateTrigger returns update-system's trigger for the schedule, it
+// changes, and so updates the host, at most once per period. Days and weeks
+// are UTC ones.
+func computeUpdateTrigger(schedule string) string {
+	now := time.Now().UTC()
+	switch schedule {
+	case "always":
+		return now.Format(time.RFC3339Nano)
+	case "daily":
+		return now.Truncate(24 * time.Hour).Format(time.DateOnly)
+	case "weekly":
+		year, week := now.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	default:
+		return "never"
+	}
+}
+
+// newCommand creates the remote.Command resource for c and records it in
+// created, which is also where c.After dependencies are looked up.
+// Any triggers replace the command, and so run it again, when they change.
+func newCommand(ctx *pulumi.Context, c CommandSpec, connection remote.ConnectionArgs, created map[string]*remote.Command) (*remote.Command, error) {
+	ctx.Log.Info(fmt.Sprintf("%s: '%s'", c.Name, c.display()), nil)
+
+	var opts []pulumi.ResourceOption
+	for _, name := range c.After {
+		dep, ok := created[name]
+		if !ok {
+			return nil, fmt.Errorf("command '%s' must run after unknown command '%s'", c.Name, name)
+		}
+		opts = append(opts, pulumi.DependsOn([]pulumi.Resource{dep}))
+	}
+	if c.Timeout > 0 {
+		opts = append(opts, pulumi.Timeouts(&pulumi.CustomTimeouts{Create: c.Timeout.String(), Update: c.Timeout.String()}))
+	}
+
+	var create pulumi.StringInput = pulumi.String(c.command())
+	if c.Secret {
+		create = pulumi.ToSecret(create).(pulumi.StringOutput)
+	}
+	triggers := pulumi.Array{create}
+	if c.Trigger != "" {
+		triggers = append(triggers, pulumi.String(c.Trigger))
+	}
+	if c.RerunWithAfter {
+		for _, name := range c.After {
+			triggers = append(triggers, created[name].ID())
+		}
+	}
+
+	r, err := remote.NewCommand(ctx, c.Name, &remote.CommandArgs{
+		Connection: connection,
+		Create:     create,
+		Triggers:   triggers,
+	}, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run command '%s': %w", c.display(), err)
+	}
+
+	created[c.Name] = r
+	return r, nil
+}
+
+// sshTarget returns where the OrbStack machine's SSH server is, always on
+// localhost, or the WSL instance's if wsl is set. OrbStack sends plain logins
+// to the default machine, user@machine picks the named one.
+func sshTarget(username, machine string, wsl bool) SSHTarget {
+	if wsl {
+		return SSHTarget{User: username, Host: "wsl.localhost", Port: 22}
+	}
+	if machine != "" {
+		username += "@" + machine
+	}
+	return SSHTarget{User: username, Host: "localhost", Port: 32222}
+}
+
+// sshConnection returns the connection to sshTarget.
+func sshConnection(username, machine string, wsl bool) (remote.ConnectionArgs, error) {
+	keyFile := "$HOME/.orbstack/ssh/id_ed25519"
+	if wsl {
+		keyFile = "$HOME/.ssh/id_ed25519"
+	}
+	target := sshTarget(username, machine, wsl)
+
+	key, err := os.ReadFile(os.ExpandEnv(keyFile))
+	if err != nil {
+		return remote.ConnectionArgs{}, fmt.Errorf("failed to read private key: %w", err)
+	}
+
+	return remote.ConnectionArgs{
+		Host:       pulumi.String(target.Host),
+		Port:       pulumi.Float64(target.Port),
+		User:       pulumi.String(target.User),
+		PrivateKey: pulumi.String(string(key)),
+	}, nil
+}
+
+// trustHostKey adds the target's host keys to this machine's known_hosts,
+// skipping those already there so repeated runs don't grow the file.
+func trustHostKey(target SSHTarget) error {
+	out, err := exec.Command("ssh-keyscan", "-p", strconv.Itoa(target.Port), target.Host).Output()
+	if err != nil {
+		return fmt.Errorf("failed to scan host keys of %s: %w", target.Host, err)
+	}
+
+	knownHosts := os.ExpandEnv("$HOME/.ssh/known_hosts")
+	if err := os.MkdirAll(filepath.Dir(knownHosts), 0o700); err != nil {
+		return err
+	}
+	existing, err := os.ReadFile(knownHosts)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	trusted := strings.Split(string(existing), "\n")
+	var missing []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") && !slices.Contains(trusted, line) {
+			missing = append(missing, line+"\n")
+		}
+	}
+
+	f, err := os.OpenFile(knownHosts, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(strings.Join(missing, ""))
+	return err
+}
+
+// hostOutput runs cmd on the host and returns its output. It dials the host
+// itself rather than through a remote.Command, whose output is only known
+// once the program has finished, so the connection has to hold plain values.
+func hostOutput(connection remote.ConnectionArgs, cmd string) (string, error) {
+	host, ok1 := connection.Host.(pulumi.String)
+	port, ok2 := connection.Port.(pulumi.Float64)
+	user, ok3 := connection.User.(pulumi.String)
+	key, ok4 := connection.PrivateKey.(pulumi.String)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return "", errors.New("connection must be made of plain values")
+	}
+
+	signer, err := ssh.ParsePrivateKey([]byte(key))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	// Like the command provider, which doesn't check host keys either
+	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", host, int(port)), &ssh.ClientConfig{
+		User:            string(user),
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	out, err := session.Output(cmd)
+	return string(out), err
+}
+
+// detectDistribution reads /etc/os-release on the host.
+func detectDistribution(ctx *pulumi.Context, connection remote.ConnectionArgs) (string, error) {
+	// macOS has no os-release
+	out, err := hostOutput(connection, "cat /etc/os-release 2> /dev/null || uname -s")
+	if err != nil {
+		return "", err
+	}
+
+	distribution, err := parseOSRelease(out)
+	if err != nil {
+		return "", err
+	}
+
+	ctx.Log.Info(fmt.Sprintf("Detected distribution: %s", distribution), nil)
+	return distribution, nil
+}
+
+// detectArch returns the host's architecture, normalized.
+func detectArch(ctx *pulumi.Context, connection remote.ConnectionArgs) (string, error) {
+	out, err := hostOutput(connection, "uname -m")
+	if err != nil {
+		return "", err
+	}
+
+	arch := normalizeArch(strings.TrimSpace(out))
+	ctx.Log.Info(fmt.Sprintf("Detected architecture: %s", arch), nil)
+	return arch, nil
+}
+
+// parseOSRelease maps an os-release file, or "Darwin", to a distribution.
+func parseOSRelease(osRelease string) (string, error) {
+	if strings.TrimSpace(osRelease) == "Darwin" {
+		return "macos", nil
+	}
+
+	fields := map[string]string{}
+	for _, line := range strings.Split(osRelease, "\n") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(line), "="); ok {
+			fields[k] = strings.Trim(v, `"'`)
+		}
+	}
+
+	switch id := fields["ID"]; id {
+	case "fedora":
+		switch fields["VARIANT_ID"] {
+		case "silverblue":
+			return "fedora-silverblue", nil
+		case "coreos":
+			return "fedora-coreos", nil
+		}
+		return "fedora", nil
+	case "amzn":
+		if fields["VERSION_ID"] == "2023" {
+			return "amazonlinux2023", nil
+		}
+		return "", fmt.Errorf("unsupported Amazon Linux version: %s", fields["VERSION_ID"])
+	case "ubuntu", "debian", "arch", "gentoo", "rhel":
+		return id, nil
+	default:
+		return "", fmt.Errorf("unsupported distribution: %s", id)
+	}
+}
+
+// buildAndPushImage builds the Dockerfile, read from stdin so nothing else
+// is sent as build context, and pushes the image to its registry.
+func buildAndPushImage(dockerfile, image string) error {
+	build := exec.Command("docker", "build", "-t", image, "-")
+	build.Stdin = strings.NewReader(dockerfile)
+	if out, err := build.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to build image '%s': %w: %s", image, err, out)
+	}
+
+	if out, err := exec.Command("docker", "push", image).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to push image '%s': %w: %s", image, err, out)
+	}
+	return nil
+}
+
+// orbMachineRunning reports whether the OrbStack machine exists and accepts
+// commands.
+func orbMachineRunning(name string) bool {
+	return exec.Command("orb", "run", "-m", name, "true").Run() == nil
+}
+
+// createOrbMachine creates the OrbStack machine unless it already exists.
+// OrbStack's memory limit is global, a non-zero memoryGB changes it for all
+// machines.
+func createOrbMachine(name, distro, arch string, memoryGB int) error {
+	if memoryGB > 0 {
+		if out, err := exec.Command("orb", "config", "set", "memory_mib", strconv.Itoa(memoryGB*1024)).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to set OrbStack memory: %w: %s", err, out)
+		}
+	}
+
+	if orbMachineRunning(name) {
+		return nil
+	}
+
+	if out, err := exec.Command("orb", "create", "--arch", arch, distro, name).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to create machine '%s': %w: %s", name, err, out)
+	}
+	return waitForMachineReady(name)
+}
+
+// snapshotOrbMachineAfter snapshots the OrbStack machine once every command in
+// created has finished.
+func snapshotOrbMachineAfter(ctx *pulumi.Context, name, snapshot string, created map[string]*remote.Command) {
+	var outputs []interface{}
+	for _, r := range created {
+		outputs = append(outputs, r.Stdout)
+	}
+
+	pulumi.All(outputs...).ApplyT(func([]interface{}) error {
+		if out, err := exec.Command("orb", "snapshot", "create", name, snapshot).CombinedOutput(); err != nil {
+			err = fmt.Errorf("failed to snapshot machine '%s': %w: %s", name, err, out)
+			ctx.Log.Error(err.Error(), nil)
+			return err
+		}
+
+		ctx.Log.Info(fmt.Sprintf("Created snapshot '%s' of machine '%s'", snapshot, name), nil)
+		return nil
+	})
+}
+
+func waitForMachineReady(name string) error {
+	deadline := time.Now().Add(2 * time.Minute)
+	for !orbMachineRunning(name) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("machine '%s' not ready after 2 minutes", name)
+		}
+		time.Sleep(2 * time.Second)
+	}
+	return nil
+}
+
+// waitForReboot returns a command that only succeeds once the host is back
+// up after the reboot scheduled by the command it follows.
+func waitForReboot(ctx *pulumi.Context, name string, connection remote.ConnectionArgs, rebooting *remote.Command) (*remote.Command, error) {
+	// Give the host time to actually go down before trying to reconnect
+	sleep, err := local.NewCommand(ctx, name+"-sleep", &local.CommandArgs{
+		Create:   pulumi.String("sleep 30"),
+		Triggers: pulumi.Array{rebooting.ID()},
+	}, pulumi.DependsOn([]pulumi.Resource{rebooting}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to wait for reboot: %w", err)
+	}
+
+	// Keep dialing for a few minutes while the host boots
+	connection.DialErrorLimit = pulumi.Int(20)
+
+	r, err := remote.NewCommand(ctx, name, &remote.CommandArgs{
+		Connection: connection,
+		Create:     pulumi.String("uptime"),
+		Triggers:   pulumi.Array{rebooting.ID()},
+	}, pulumi.DependsOn([]pulumi.Resource{sleep}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to wait for reboot: %w", err)
+	}
+	return r, nil
+}
+
+// exportOutputs registers the command's stdout and stderr as stack outputs.
+func exportOutputs(ctx *pulumi.Context, c CommandSpec, r *remote.Command) {
+	var stdout, stderr pulumi.Output = r.Stdout, r.Stderr
+	if c.Secret {
+		stdout, stderr = pulumi.ToSecret(stdout), pulumi.ToSecret(stderr)
+	}
+
+	ctx.Export(c.Name+"-stdout", stdout)
+	ctx.Export(c.Name+"-stderr", stderr)
+}
+
+// benchmark records when each command finished and what it printed. A
+// command's duration counts from the moment its last dependency finished, or
+// from the start of the run.
+type benchmark struct {
+	start    time.Time
+	deps     map[string][]string
+	commands map[string]CommandSpec
+	outputs  []interface{}
+	mu       sync.Mutex
+	finished map[string]time.Time
+	stdout   map[string]string
+	stderr   map[string]string
+}
+
+func newBenchmark() *benchmark {
+	return &benchmark{
+		start:    time.Now(),
+		deps:     map[string][]string{},
+		commands: map[string]CommandSpec{},
+		finished: map[string]time.Time{},
+		stdout:   map[string]string{},
+		stderr:   map[string]string{},
+	}
+}
+
+func (b *benchmark) track(c CommandSpec, r *remote.Command) {
+	b.deps[c.Name] = c.After
+	b.commands[c.Name] = c
+	b.outputs = append(b.outputs, pulumi.All(r.Stdout, r.Stderr).ApplyT(func(out []interface{}) string {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		b.finished[c.Name] = time.Now()
+		b.stdout[c.Name], b.stderr[c.Name] = out[0].(string), out[1].(string)
+		return c.Name
+	}))
+}
+
+// durations returns the time each command took in seconds.
+func (b *benchmark) durations() map[string]float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	durations := map[string]float64{}
+	for name, end := range b.finished {
+		start := b.start
+		for _, dep := range b.deps[name] {
+			if t, ok := b.finished[dep]; ok && t.After(start) {
+				start = t
+			}
+		}
+		durations[name] = end.Sub(start).Seconds()
+	}
+	return durations
+}
+
+// report logs the timings, slowest first, once every command has finished and
+// exports them as the "timings" stack output.
+func (b *benchmark) report(ctx *pulumi.Context) {
+	ctx.Export("timings", pulumi.All(b.outputs...).ApplyT(func([]interface{}) map[string]float64 {
+		durations := b.durations()
+		names := slices.SortedFunc(maps.Keys(durations), func(x, y string) int {
+			return cmp.Compare(durations[y], durations[x])
+		})
+
+		var summary strings.Builder
+		summary.WriteString("Command timings:")
+		for _, name := range names {
+			fmt.Fprintf(&summary, "\n%8.1fs %s", durations[name], name)
+		}
+		ctx.Log.Info(summary.String(), nil)
+
+		return durations
+	}))
+}
+
+// commandLogEntry is one command in the log file. Failed commands fail the
+// update before their output reaches the program, so every logged command
+// exited with 0.
+type commandLogEntry struct {
+	Name     string    `json:"name"`
+	Command  string    `json:"command"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration"`
+	ExitCode int       `json:"exitCode"`
+	Stdout   string    `json:"stdout"`
+	Stderr   string    `json:"stderr"`
+}
+
+// writeLog writes a JSON log of every finished command to file, in the order
+// they finished, once all of them have.
+func (b *benchmark) writeLog(ctx *pulumi.Context, file string) {
+	pulumi.All(b.outputs...).ApplyT(func([]interface{}) error {
+		durations := b.durations()
+
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		names := slices.SortedFunc(maps.Keys(b.finished), func(x, y string) int {
+			return b.finished[x].Compare(b.finished[y])
+		})
+
+		var entries []commandLogEntry
+		for _, name := range names {
+			c := b.commands[name]
+			stdout, stderr := b.stdout[name], b.stderr[name]
+			if c.Secret {
+				stdout, stderr = "<secret>", "<secret>"
+			}
+
+			elapsed := time.Duration(durations[name] * float64(time.Second))
+			entries = append(entries, commandLogEntry{
+				Name:     name,
+				Command:  c.display(),
+				Start:    b.finished[name].Add(-elapsed),
+				Duration: durations[name],
+				Stdout:   stdout,
+				Stderr:   stderr,
+			})
+		}
+
+		data, err := json.MarshalIndent(entries, "", "  ")
+		if err == nil {
+			err = writeGeneratedFile(file, append(data, '\n'), 0o600)
+		}
+		if err != nil {
+			ctx.Log.Error(fmt.Sprintf("Failed to write log file: %v", err), nil)
+		}
+		return err
+	})
+}
+
+// UserConfig is an additional account with its own dotfiles, the shared
+// packages are installed for everyone.
+type UserConfig struct {
+	Username     string `json:"username"`
+	Shell        string `json:"shell"`
+	DotfilesRepo string `json:"dotfilesRepo"`
+}
+
+// userCommands creates the account if needed and runs its per-user setup
+// steps as that user, once the packages are installed. The username also
+// goes into the command names, so it is limited to what isSafeName allows.
+func userCommands(user UserConfig) ([]CommandSpec, error) {
+	if user.Username == "" {
+		return nil, errors.New("username is required")
+	}
+	if !isSafeName(user.Username) || strings.HasPrefix(user.Username, "-") {
+		return nil, fmt.Errorf("invalid username: %s", user.Username)
+	}
+
+	shell := shellQuote(cmp.Or(user.Shell, "/bin/zsh"))
+	repo := user.DotfilesRepo
+	if repo == "" {
+		repo = "https://github.com/ismail/config.git"
+	}
+	asUser := func(cmd string) string {
+		return fmt.Sprintf("sudo -iu %s sh -c %s", user.Username, shellQuote(cmd))
+	}
+
+	prefix := "user-" + user.Username
+	return []CommandSpec{
+		{Name: prefix + "-create", Cmd: fmt.Sprintf("sudo useradd -m -s %s %s", shell, user.Username), Condition: fmt.Sprintf("! id -u %s > /dev/null 2>&1", user.Username), After: []string{"install-packages"}},
+		{Name: prefix + "-setup-config", Cmd: asUser(fmt.Sprintf("rm -rf ~/github/config && git clone %s ~/github/config && if [ -x ~/github/config/setup.sh ]; then ~/github/config/setup.sh; fi", shellQuote(repo))), After: []string{prefix + "-create"}},
+		{Name: prefix + "-use-shell", Cmd: fmt.Sprintf("sudo chsh -s %s %s", shell, user.Username), After: []string{prefix + "-create"}},
+	}, nil
+}
+
+// runHandlers runs each handler after the commands in its After, and again
+// whenever one of them is replaced.
+func runHandlers(ctx *pulumi.Context, handlers []CommandSpec, connection remote.ConnectionArgs, created map[string]*remote.Command, verbose bool, bench *benchmark) error {
+	for _, h := range handlers {
+		h.RerunWithAfter = true
+		r, err := newCommand(ctx, h, connection, created)
+		if err != nil {
+			return err
+		}
+
+		if verbose {
+			exportOutputs(ctx, h, r)
+		}
+		if bench != nil {
+			bench.track(h, r)
+		}
+	}
+	return nil
+}
+
+// runIndependentCommands runs commands concurrently. bench is nil unless
+// benchmarking or logging.
+func runIndependentCommands(ctx *pulumi.Context, commands []CommandSpec, connection remote.ConnectionArgs, created map[string]*remote.Command, verbose bool, bench *benchmark) error {
+	for _, c := range commands {
+		r, err := newCommand(ctx, c, connection, created)
+		if err != nil {
+			return err
+		}
+
+		if verbose {
+			exportOutputs(ctx, c, r)
+		}
+		if bench != nil {
+			bench.track(c, r)
+		}
+	}
+	return nil
+}
+
+// runOrderedCommands runs commands one after another. It returns the last command that
+// rebooted the host, if any. bench is nil unless benchmarking or logging.
+func runOrderedCommands(ctx *pulumi.Context, commands []CommandSpec, connection remote.ConnectionArgs, created map[string]*remote.Command, verbose bool, bench *benchmark) (string, error) {
+	var last, rebooted string
+
+	for _, c := range commands {
+
+		if last != "" && !c.Parallel {
+			c.After = append(slices.Clone(c.After), last)
+		}
+
+		r, err := newCommand(ctx, c, connection, created)
+		if err != nil {
+			return "", err
+		}
+
+		if verbose {
+			exportOutputs(ctx, c, r)
+		}
+		if bench != nil {
+			bench.track(c, r)
+		}
+
+		if c.Parallel {
+			continue
+		}
+
+		last = c.Name
+		if c.RequiresReboot {
+			// Anything that runs after the command waits for the host to come
+			// back, the command itself stays reachable under the waiter's
+			// name
+			waiter := c.Name + "-wait-for-reboot"
+			w, err := waitForReboot(ctx, waiter, connection, r)
+			if err != nil {
+				return "", err
+			}
+
+			created[waiter], created[c.Name] = r, w
+			rebooted = c.Name
+			if bench != nil {
+				bench.track(CommandSpec{Name: waiter, Cmd: "uptime", After: []string{c.Name}}, w)
+			}
+		}
+	}
+	return rebooted, nil
+}
+
+// validateConfig reports every missing or invalid config key at once, before
+// anything touches the machine.
+func validateConfig(cfg *config.Config) error {
+	var errs []error
+
+	// distribution is detected on the host when it's not set
+	for _, key := range []string{"sshUsername"} {
+		if _, err := cfg.Try(key); err != nil {
+			errs = append(errs, fmt.Errorf("missing required config key '%s'", key))
+		}
+	}
+
+	if distribution := cfg.Get("distribution"); distribution != "" {
+		if _, err := installCmd(distribution); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// Keys that become required once a feature is enabled
+	for _, dep := range []struct {
+		feature string
+		key     string
+	}{
+		{"createOrbMachine", "orbMachineName"},
+		{"generateSSHHostKey", "sshHostKeySeed"},
+		{"useCloudInit", "distribution"},
+		{"useCloudInit", "targetArch"},
+		{"createSnapshot", "orbMachineName"},
+		{"buildAndPushImage", "imageRegistry"},
+		{"buildAndPushImage", "imageName"},
+	} {
+		if cfg.GetBool(dep.feature) && cfg.Get(dep.key) == "" {
+			errs = append(errs, fmt.Errorf("config key '%s' is required when '%s' is set", dep.key, dep.feature))
+		}
+	}
+
+	if cfg.Get("distribution") == "rhel" {
+		keys := []string{"rhelUsername", "rhelPassword"}
+		if cfg.Get("rhelActivationKey") != "" {
+			keys = []string{"rhelOrg"}
+		}
+		for _, key := range keys {
+			if cfg.Get(key) == "" {
+				errs = append(errs, fmt.Errorf("config key '%s' is required for rhel", key))
+			}
+		}
+	}
+
+	// The machine is created before there is a host to detect anything on
+	if cfg.GetBool("createOrbMachine") && cfg.Get("distribution") == "" && cfg.Get("orbDistro") == "" {
+		errs = append(errs, errors.New("config key 'distribution' or 'orbDistro' is required when 'createOrbMachine' is set"))
+	}
+
+	// Both would set SSH_AUTH_SOCK
+	if cfg.GetBool("useGPGAgent") && cfg.GetBool("sshAgentService") {
+		errs = append(errs, errors.New("useGPGAgent and sshAgentService can't both be set"))
+	}
+
+	var nfsMounts []NFSMount
+	if err := cfg.GetObject("nfsMounts", &nfsMounts); err != nil {
+		errs = append(errs, fmt.Errorf("failed to parse nfsMounts: %w", err))
+	}
+	for _, m := range nfsMounts {
+		if err := m.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// The timer is a systemd user unit on the machine running pulumi up
+	if cfg.GetBool("scheduleAutoUpdate") && runtime.GOOS != "linux" {
+		errs = append(errs, fmt.Errorf("scheduleAutoUpdate needs systemd on the machine running pulumi up, it isn't supported on %s", runtime.GOOS))
+	}
+
+	if cfg.Get("gitSigningKey") != "" {
+		if _, err := gitSigningCmd("", cfg.Get("gitSigningMethod"), ""); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func main() {
+	pulumi.Run(func(ctx *pulumi.Context) error {
+		cfg := config.New(ctx, ctx.Stack())
+		if err := validateConfig(cfg); err != nil {
+			return fmt.Errorf("invalid config:\n%w", err)
+		}
+
+		distribution := cfg.Get("distribution")
+		sshUsername := cfg.Require("sshUsername")
+		wsl := cfg.GetBool("wsl")
+		orbMachine := cfg.Get("orbMachineName")
+
+		// The workflow is written locally and meant to be committed
+		if cfg.GetBool("generateWorkflow") {
+			var secrets []string
+			if err := cfg.GetObject("workflowSecrets", &secrets); err != nil {
+				return fmt.Errorf("failed to parse workflowSecrets: %w", err)
+			}
+
+			workflow := generateGHAWorkflow(WorkflowConfig{Stack: ctx.Stack(), Secrets: secrets})
+			if err := os.MkdirAll(".github/workflows", 0o755); err != nil {
+				return fmt.Errorf("failed to create workflow directory: %w", err)
+			}
+			if err := os.WriteFile(".github/workflows/provision.yml", []byte(workflow), 0o644); err != nil {
+				return fmt.Errorf("failed to write workflow: %w", err)
+			}
+		}
+
+		// Architectures go by their Go names, amd64 and arm64. Machines
+		// OrbStack creates get it, or the Mac's own, so there is no host to
+		// ask during a preview.
+		targetArch := normalizeArch(cfg.Get("targetArch"))
+		if cfg.GetBool("createOrbMachine") {
+			targetArch = cmp.Or(targetArch, runtime.GOARCH)
+		}
+
+		// Previews must not create machines
+		if cfg.GetBool("createOrbMachine") && !ctx.DryRun() {
+			orbDistro := cfg.Get("orbDistro")
+			if orbDistro == "" {
+				orbDistro = distribution
+			}
+
+			if err := createOrbMachine(orbMachine, orbDistro, targetArch, cfg.GetInt("orbMemoryGB")); err != nil {
+				return err
+			}
+		}
+
+		if distribution == "" || targetArch == "" {
+			connection, err := sshConnection(sshUsername, orbMachine, wsl)
+			if err != nil {
+				return err
+			}
+			if distribution == "" {
+				if distribution, err = detectDistribution(ctx, connection); err != nil {
+					return fmt.Errorf("failed to detect distribution: %w", err)
+				}
+			}
+			if targetArch == "" {
+				if targetArch, err = detectArch(ctx, connection); err != nil {
+					return fmt.Errorf("failed to detect architecture: %w", err)
+				}
+			}
+		}
+
+		// Silverblue can be set up inside a distrobox like Fedora CoreOS,
+		// which always is. Other hosts can install packages themselves.
+		// packageDistribution is whose package manager installs the packages,
+		// the dev container's for those hosts.
+		useDevContainer := usesDevContainer(distribution)
+		if cfg.GetBool("useDistrobox") {
+			switch {
+			case isOSTree(distribution):
+				ctx.Log.Info(fmt.Sprintf("Setting up %s inside a distrobox", distribution), nil)
+				useDevContainer = true
+			case !useDevContainer:
+				return fmt.Errorf("useDistrobox is not supported on %s, it isn't an immutable host", distribution)
+			}
+		}
+		packageDistribution := distribution
+		if useDevContainer {
+			packageDistribution = "fedora-coreos"
+		}
+
+		installCmd, err := installCmd(packageDistribution)
+		if err != nil {
+			return fmt.Errorf("failed to get install command: %w", err)
+		}
+
+		updateCmd, err := updateCmd(packageDistribution)
+		if err != nil {
+			return fmt.Errorf("failed to get update command: %w", err)
+		}
+
+		manifest, err := loadPackageManifest(cfg.Get("packageManifest"))
+		if err != nil {
+			return fmt.Errorf("failed to load package manifest: %w", err)
+		}
+
+		packages := withoutPackages(strings.Join(manifest.CommonPackages, " "), unavailablePackages(distribution))
+		extraPackages := manifest.extraPackagesForDistro(distribution)
+
+		var profile HostProfile
+		if name := cfg.Get("profileName"); name != "" {
+			var profiles map[string]HostProfile
+			if err := cfg.GetObject("profiles", &profiles); err != nil {
+				return fmt.Errorf("failed to parse profiles: %w", err)
+			}
+
+			if profile, err = manifest.profile(name, distribution, profiles); err != nil {
+				return err
+			}
+			extraPackages = append(extraPackages, profile.ExtraPackages...)
+		}
+
+		// "stable" comes from the package manager, anything else is an AppImage release
+		neovimVersion := cfg.Get("neovimVersion")
+		if neovimVersion == "stable" {
+			extraPackages = append(extraPackages, "neovim")
+		}
+
+		// Gentoo and Homebrew build emacs without X by default
+		installEmacs := cfg.GetBool("installEmacs")
+		if installEmacs {
+			emacs := "emacs"
+			if cfg.GetBool("emacsNoX") && distribution != "gentoo" && distribution != "macos" {
+				emacs = "emacs-nox"
+			}
+			extraPackages = append(extraPackages, emacs)
+		}
+
+		// Debian splits systemd-coredump out of systemd
+		configureCoredump := cfg.GetBool("configureCoredump") && isLinux(distribution)
+		if configureCoredump && (distribution == "ubuntu" || distribution == "debian") {
+			extraPackages = append(extraPackages, "systemd-coredump")
+		}
+
+		// Both package the exporter as a service reading its flags from ARGS
+		// in /etc/default
+		installNodeExporter := cfg.GetBool("installNodeExporter")
+		if installNodeExporter {
+			if !slices.Contains([]string{"fedora", "ubuntu", "debian"}, distribution) {
+				return fmt.Errorf("installNodeExporter is not supported on %s", distribution)
+			}
+			extraPackages = append(extraPackages, "prometheus-node-exporter")
+		}
+
+		useRemoteSession := cfg.GetBool("useRemoteSession")
+		if useRemoteSession {
+			extraPackages = append(extraPackages, "tmux")
+		}
+
+		// Default to lldb whenever clang is installed
+		installLLDB, err := cfg.TryBool("installLLDB")
+		if err != nil {
+			installLLDB = slices.Contains(strings.Fields(packages), "clang")
+		}
+		if installLLDB {
+			extraPackages = append(extraPackages, "lldb")
+		}
+
+		installFail2ban := cfg.GetBool("installFail2ban")
+		if installFail2ban {
+			extraPackages = append(extraPackages, "fail2ban")
+		}
+
+		useGPGAgent := cfg.GetBool("useGPGAgent")
+		if useGPGAgent {
+			extraPackages = append(extraPackages, gnupgPackage(distribution))
+		}
+
+		var systemEnv map[string]string
+		if err := cfg.GetObject("systemEnv", &systemEnv); err != nil {
+			return fmt.Errorf("failed to parse systemEnv: %w", err)
+		}
+
+		var nfsMounts []NFSMount
+		if err := cfg.GetObject("nfsMounts", &nfsMounts); err != nil {
+			return fmt.Errorf("failed to parse nfsMounts: %w", err)
+		}
+		if len(nfsMounts) > 0 {
+			if pkg := nfsClientPackage(distribution); pkg != "" {
+				extraPackages = append(extraPackages, pkg)
+			}
+		}
+
+		var udevRules []UdevRule
+		if err := cfg.GetObject("udevRules", &udevRules); err != nil {
+			return fmt.Errorf("failed to parse udevRules: %w", err)
+		}
+
+		var aptPins []AptPin
+		if err := cfg.GetObject("aptPins", &aptPins); err != nil {
+			return fmt.Errorf("failed to parse aptPins: %w", err)
+		}
+
+		var aurPackages []string
+		if err := cfg.GetObject("aurPackages", &aurPackages); err != nil {
+			return fmt.Errorf("failed to parse aurPackages: %w", err)
+		}
+
+		var additionalSSHKeys []string
+		if err := cfg.GetObject("additionalSSHKeys", &additionalSSHKeys); err != nil {
+			return fmt.Errorf("failed to parse additionalSSHKeys: %w", err)
+		}
+
+		var sshClientConfigEntries []SSHConfigEntry
+		if err := cfg.GetObject("sshClientConfigEntries", &sshClientConfigEntries); err != nil {
+			return fmt.Errorf("failed to parse sshClientConfigEntries: %w", err)
+		}
+
+		var brewCaskPackages []string
+		if err := cfg.GetObject("brewCaskPackages", &brewCaskPackages); err != nil {
+			return fmt.Errorf("failed to parse brewCaskPackages: %w", err)
+		}
+
+		// Values are plaintext here, the setup-secrets command keeps them secret
+		var shellSecrets map[string]string
+		if _, err := cfg.GetSecretObject("shellSecrets", &shellSecrets); err != nil {
+			return fmt.Errorf("failed to parse shellSecrets: %w", err)
+		}
+
+		var gitConfig GitConfig
+		if err := cfg.GetObject("gitConfig", &gitConfig); err != nil {
+			return fmt.Errorf("failed to parse gitConfig: %w", err)
+		}
+
+		// cargo has no edition setting, rustfmt's is the global default
+		rustEdition := cfg.Get("rustEdition")
+
+		// Snippets for the devenv block of ~/.cargo/config.toml
+		var cargoConfig []string
+		if isLinux(distribution) && slices.Contains(strings.Fields(packages), "mold") {
+			cargoConfig = append(cargoConfig, cargoMoldConfig(targetArch))
+		}
+
+		// The agent config reads the address from VAULT_ADDR too. The token
+		// is only given to setup-secrets, but it has to be stored encrypted.
+		for key, name := range map[string]string{"vaultAddr": "VAULT_ADDR", "vaultToken": "VAULT_TOKEN"} {
+			if v := cfg.Get(key); v != "" {
+				if key == "vaultToken" && !ctx.IsConfigSecret(ctx.Stack()+":"+key) {
+					return errors.New("vaultToken must be set with pulumi config set --secret")
+				}
+				if shellSecrets == nil {
+					shellSecrets = map[string]string{}
+				}
+				shellSecrets[name] = v
+			}
+		}
+
+		// Extra lines for ~/.zlogin
+		var zlogin []string
+		if len(shellSecrets) > 0 {
+			zlogin = append(zlogin, "[ -f ~/.secrets.sh ] && source ~/.secrets.sh")
+		}
+
+		// Tools disagree on the case, both get set
+		httpProxy, httpsProxy := cfg.Get("httpProxy"), cfg.Get("httpsProxy")
+		proxyEnv := map[string]string{}
+		for _, p := range []struct{ name, value string }{{"http_proxy", httpProxy}, {"https_proxy", httpsProxy}} {
+			if p.value != "" {
+				proxyEnv[p.name] = p.value
+				proxyEnv[strings.ToUpper(p.name)] = p.value
+			}
+		}
+		// Windows' PATH is appended by default, searching it makes every
+		// completion slow. Windows programs stay reachable by full path.
+		if wsl {
+			zlogin = append(zlogin, "path=(${path:#/mnt/[a-z]/*})")
+		}
+
+		histSize := cfg.GetInt("zshHistSize")
+		if histSize == 0 {
+			histSize = 100000
+		}
+		histFile := cfg.Get("zshHistFile")
+		if histFile == "" {
+			histFile = "~/.zsh_history"
+		}
+		histDups := cfg.Get("zshHistDups")
+		if histDups == "" {
+			histDups = "erase"
+		}
+		history, err := zshHistory(histSize, histFile, histDups)
+		if err != nil {
+			return err
+		}
+		zlogin = append(zlogin, history)
+
+		// An empty list turns the defaults off
+		zshOptions := defaultZshOptions
+		if cfg.Get("zshOptions") != "" {
+			if err := cfg.GetObject("zshOptions", &zshOptions); err != nil {
+				return fmt.Errorf("failed to parse zshOptions: %w", err)
+			}
+		}
+		if len(zshOptions) > 0 {
+			setopts, err := zshOptionsLines(zshOptions)
+			if err != nil {
+				return err
+			}
+			zlogin = append(zlogin, setopts)
+		}
+
+		zshPlugin := cfg.Get("zshPlugin")
+		if zshPlugin != "" && zshPlugin != "oh-my-zsh" {
+			return fmt.Errorf("unsupported zshPlugin: %s", zshPlugin)
+		}
+		// Themes only exist for oh-my-zsh
+		var zshTheme string
+		if zshPlugin == "oh-my-zsh" {
+			zshTheme = cfg.Get("zshTheme")
+		}
+
+		// Only dates, messages keep the system locale
+		if locale := cfg.Get("shellDateFormat"); locale != "" {
+			zlogin = append(zlogin, fmt.Sprintf("export LC_TIME=%s", shellQuote(locale)))
+		}
+
+		jsManager := cfg.Get("jsToolchainManager")
+		jsInstallCmd, err := jsManagerInstallCmd(jsManager)
+		if err != nil {
+			return err
+		}
+		if init := shellInitForJSManager(jsManager, "zsh"); init != "" {
+			zlogin = append(zlogin, init)
+		}
+
+		sshAgentService := cfg.GetBool("sshAgentService")
+		if sshAgentService {
+			zlogin = append(zlogin, "export SSH_AUTH_SOCK=\"$XDG_RUNTIME_DIR/ssh-agent.socket\"")
+		}
+
+		// updatestartuptty points pinentry at the current terminal
+		if useGPGAgent {
+			zlogin = append(zlogin, strings.Join([]string{
+				"export GPG_TTY=\"$(tty)\"",
+				"export SSH_AUTH_SOCK=\"$(gpgconf --list-dirs agent-ssh-socket)\"",
+				"gpg-connect-agent updatestartuptty /bye > /dev/null",
+			}, "\n"))
+		}
+
+		crates := manifest.CargoPackages
+		if c := cfg.Get("cargoPackages"); c != "" {
+			if crates, err = parseCargoPackages(c); err != nil {
+				return fmt.Errorf("failed to parse cargoPackages: %w", err)
+			}
+		}
+		crates = append(slices.Clone(crates), profile.CargoPackages...)
+
+		// The wrapper has to exist before cargo uses config.toml
+		installSccache := cfg.GetBool("installSccache")
+		configureCargoAfter := "install-cargo"
+		if installSccache {
+			crates = append(crates, CargoPinnedPackage{Name: "sccache"})
+			cargoConfig = append(cargoConfig, "[build]\nrustc-wrapper = \"sccache\"")
+			configureCargoAfter = "install-cargo-packages"
+
+			cacheGB := cfg.GetInt("sccacheCacheGB")
+			if cacheGB == 0 {
+				cacheGB = 10
+			}
+			zlogin = append(zlogin, fmt.Sprintf("export SCCACHE_CACHE_SIZE=\"%dG\"", cacheGB))
+		}
+
+		// cross builds in containers, the host only needs the targets and a
+		// linker for them
+		var rustCrossTargets []string
+		if err := cfg.GetObject("rustCrossTargets", &rustCrossTargets); err != nil {
+			return fmt.Errorf("failed to parse rustCrossTargets: %w", err)
+		}
+		if cfg.GetBool("installCross") {
+			crates = append(crates, CargoPinnedPackage{Name: "cross"})
+		}
+		for _, target := range rustCrossTargets {
+			if pkg := crossGCCPackage(distribution, targetArch, target); pkg != "" {
+				extraPackages = append(extraPackages, pkg)
+			}
+		}
+
+		// Ubuntu's git-lfs lags behind, it comes from GitHub's packagecloud
+		// repository there
+		installGitLFS := cfg.GetBool("installGitLFS")
+		if installGitLFS && distribution != "ubuntu" {
+			extraPackages = append(extraPackages, "git-lfs")
+		}
+
+		installCcache := cfg.GetBool("installCcache")
+		if installCcache {
+			extraPackages = append(extraPackages, "ccache")
+
+			maxSize := cfg.Get("ccacheMaxSize")
+			if maxSize == "" {
+				maxSize = "10G"
+			}
+			// The cc and c++ links only win if ~/.local/bin comes before the
+			// system compilers
+			zlogin = append(zlogin, strings.Join([]string{
+				"export CCACHE_DIR=~/.cache/ccache",
+				fmt.Sprintf("export CCACHE_MAXSIZE=%s", shellQuote(maxSize)),
+				"path=(~/.local/bin $path)",
+			}, "\n"))
+		}
+
+		// The bootstrap script downloads its tools as zip archives
+		installVcpkg := cfg.GetBool("installVcpkg")
+		if installVcpkg {
+			extraPackages = append(extraPackages, "zip", "unzip")
+			zlogin = append(zlogin, "export VCPKG_ROOT=~/.vcpkg\npath+=($VCPKG_ROOT)")
+		}
+
+		// SDKMAN unpacks its candidates with unzip
+		installJava := cfg.GetBool("installJava")
+		if installJava {
+			extraPackages = append(extraPackages, "zip", "unzip")
+			zlogin = append(zlogin, "[ -f ~/.sdkman/bin/sdkman-init.sh ] && source ~/.sdkman/bin/sdkman-init.sh")
+		}
+
+		// Debian's versioned llvm-config only gets on PATH through an
+		// alternative, Fedora's compat packages keep theirs out of /usr/bin
+		var llvmConfigCmd string
+		if cfg.GetBool("configureLLVMConfig") {
+			version := cfg.Get("llvmVersion")
+			switch distribution {
+			case "ubuntu", "debian":
+				if version == "" {
+					return fmt.Errorf("config key 'llvmVersion' is required for configureLLVMConfig on %s", distribution)
+				}
+				extraPackages = append(extraPackages, "llvm-"+version)
+				llvmConfigCmd = fmt.Sprintf("sudo update-alternatives --install /usr/bin/llvm-config llvm-config /usr/bin/llvm-config-%s 100", version)
+			case "fedora":
+				llvmConfig := "/usr/bin/llvm-config"
+				if version != "" {
+					extraPackages = append(extraPackages, fmt.Sprintf("llvm%s-devel", version))
+					llvmConfig = fmt.Sprintf("/usr/lib64/llvm%s/bin/llvm-config", version)
+				} else {
+					extraPackages = append(extraPackages, "llvm-devel")
+				}
+				zlogin = append(zlogin, "export LLVM_CONFIG="+llvmConfig)
+			default:
+				return fmt.Errorf("configureLLVMConfig is not supported on %s", distribution)
+			}
+		}
+
+		installAsdf := cfg.GetBool("installAsdf")
+		if installAsdf {
+			zlogin = append(zlogin, "[ -f ~/.asdf/asdf.sh ] && source ~/.asdf/asdf.sh")
+		}
+
+		enableBuildKit := cfg.GetBool("enableBuildKit")
+		if enableBuildKit {
+			zlogin = append(zlogin, "export DOCKER_BUILDKIT=1\nalias buildx='docker buildx build'")
+		}
+
+		// cargo defaults to one job per CPU
+		var cargoEnv map[string]string
+		if jobs := cfg.GetInt("cargoBuildJobs"); jobs > 0 {
+			cargoEnv = map[string]string{"CARGO_BUILD_JOBS": strconv.Itoa(jobs)}
+		}
+
+		// Adding a package still re-runs install-packages, but only the new
+		// ones get installed. Several features may ask for the same package.
+		var wanted []string
+		for _, p := range append(strings.Fields(packages), extraPackages...) {
+			if !slices.Contains(wanted, p) && !slices.Contains(manifest.ArchUnavailable[targetArch], p) {
+				wanted = append(wanted, p)
+			}
+		}
+		allPackages := manifest.distroPackageNames(distribution, wanted)
+		installPackagesCmd := fmt.Sprintf("%s %s", installCmd, strings.Join(allPackages, " "))
+		if cfg.GetBool("incrementalInstall") {
+			installPackagesCmd = incrementalInstallCmd(installCmd, allPackages)
+		}
+
+		// Without a schedule update-system only runs when its command changes
+		var updateTrigger string
+		if schedule := cfg.Get("updateSchedule"); schedule != "" {
+			if !slices.Contains(updateSchedules, schedule) {
+				return fmt.Errorf("unsupported updateSchedule: %s", schedule)
+			}
+			updateTrigger = computeUpdateTrigger(schedule)
+		}
+
+		// The setup scripts may need the submodules, so they come with the clone
+		gitClone := "git clone"
+		if cfg.GetBool("gitSubmoduleInit") {
+			gitClone = "git clone --recurse-submodules"
+		}
+
+		// These commands need to be run in order
+		setup_commands := []CommandSpec{
+			{Name: "check-arch", Cmd: "uname -m"},
+			{Name: "update-system", Cmd: updateCmd, Timeout: updateTimeout(packageDistribution), Trigger: updateTrigger},
+			{Name: "install-packages", Cmd: installPackagesCmd, Timeout: updateTimeout(packageDistribution)},
+			{Name: "install-cargo", Cmd: "curl -LsSf https://sh.rustup.rs | sh -s -- -y --no-modify-path", Condition: cargoMissing},
+			// zsh is not setup yet, we need full path to cargo
+			{Name: "install-cargo-packages", Cmd: cargoInstallCmd(crates), Env: cargoEnv},
+			{Name: "setup-config", Cmd: fmt.Sprintf("rm -rf ~/github/config && %s https://github.com/ismail/config.git ~/github/config && ~/github/config/setup.sh", gitClone)},
+			{Name: "setup-hacks", Cmd: fmt.Sprintf("rm -rf ~/github/hacks && %s https://github.com/ismail/hacks.git ~/github/hacks && ~/github/hacks/setup.sh", gitClone)},
+			{Name: "set-zlogin", Cmd: zloginCmd(zlogin, zshTheme == "")},
+			{Name: "use-zsh", Cmd: "sudo chsh -s /bin/zsh {{.Username}}", Condition: zshInstalled, Template: true},
+		}
+
+		// The host only runs containers, everything so far goes into one
+		if useDevContainer {
+			for i := range setup_commands {
+				setup_commands[i].Container = devContainerName
+			}
+
+			image := cmp.Or(cfg.Get("distroboxImage"), cfg.Get("devContainerImage"), devContainerImage)
+			setup_commands = slices.Insert(setup_commands, 0, devContainerCmds(image)...)
+		}
+
+		// Fail early on unreachable servers and mount before anything is cloned
+		if len(nfsMounts) > 0 {
+			nfsSetup, err := nfsSetupCmd(nfsMounts)
+			if err != nil {
+				return err
+			}
+			setup_commands = slices.Insert(setup_commands, 0, CommandSpec{Name: "nfs-preflight", Cmd: nfsPreflightCmd(nfsMounts)})
+			setup_commands = insertBefore(setup_commands, "install-cargo", CommandSpec{Name: "nfs-setup", Cmd: nfsSetup})
+		}
+
+		// Newer pacman.conf files enable 5 parallel downloads without the comment
+		if distribution == "arch" {
+			setup_commands = insertBefore(setup_commands, "update-system", CommandSpec{
+				Name: "configure-pacman",
+				Cmd:  `sudo sed -i 's/^#\?ParallelDownloads = .*/ParallelDownloads = 10/' /etc/pacman.conf`,
+			})
+		}
+
+		// Nothing can be installed before the host is registered. The
+		// password or activation key makes it a secret command.
+		if distribution == "rhel" {
+			setup_commands = insertBefore(setup_commands, "update-system", CommandSpec{
+				Name:   "register-rhel",
+				Cmd:    rhelRegisterCmd(cfg.Get("rhelOrg"), cfg.Get("rhelActivationKey"), cfg.Get("rhelUsername"), cfg.Get("rhelPassword")),
+				Secret: true,
+			})
+		}
+
+		// dist-upgrade already has to respect the pins
+		if (distribution == "ubuntu" || distribution == "debian") && len(aptPins) > 0 {
+			setup_commands = insertBefore(setup_commands, "update-system", CommandSpec{Name: "setup-apt-pins", Cmd: aptPinsCmd(aptPins)})
+		}
+
+		// Names have to resolve before anything is downloaded. Hosts without
+		// systemd-resolved are left alone.
+		var dnsServers []string
+		if err := cfg.GetObject("dnsServers", &dnsServers); err != nil {
+			return fmt.Errorf("failed to parse dnsServers: %w", err)
+		}
+		dnsFallback := slices.Clone(defaultFallbackDNS)
+		if err := cfg.GetObject("dnsFallbackServers", &dnsFallback); err != nil {
+			return fmt.Errorf("failed to parse dnsFallbackServers: %w", err)
+		}
+		if len(dnsServers) > 0 && isLinux(distribution) {
+			setup_commands = insertBefore(setup_commands, "update-system", CommandSpec{
+				Name:      "configure-dns",
+				Cmd:       dnsCmd(dnsServers, cfg.Get("dnsDomain"), dnsFallback),
+				Condition: "systemctl is-active --quiet systemd-resolved",
+			})
+		}
+
+		// sudo drops the proxy variables, the package manager needs its own
+		// settings. Both commands are secret, proxy URLs may have credentials.
+		if len(proxyEnv) > 0 {
+			setup_commands = insertBefore(setup_commands, "update-system", CommandSpec{Name: "set-proxy-env", Cmd: proxyEnvCmd(distribution, proxyEnv), Secret: true})
+			if cmd := proxyCmd(packageDistribution, httpProxy, httpsProxy); cmd != "" {
+				proxy := CommandSpec{Name: "configure-proxy", Cmd: cmd, Secret: true}
+				if useDevContainer {
+					proxy.Container = devContainerName
+				}
+				setup_commands = insertBefore(setup_commands, "update-system", proxy)
+			}
+		}
+
+		// yay needs base-devel and git from install-packages
+		if distribution == "arch" && len(aurPackages) > 0 {
+			setup_commands = insertBefore(setup_commands, "install-cargo",
+				CommandSpec{Name: "install-yay", Cmd: yayInstallCmd, Condition: "! command -v yay > /dev/null"},
+				CommandSpec{Name: "install-aur-packages", Cmd: fmt.Sprintf("yay -S --needed --noconfirm %s", strings.Join(aurPackages, " "))},
+			)
+		}
+
+		// rpm-ostree changes only take effect after a reboot
+		if isOSTree(distribution) && !useDevContainer {
+			for i, c := range setup_commands {
+				if c.Name == "update-system" || c.Name == "install-packages" {
+					setup_commands[i].RequiresReboot = true
+				}
+			}
+		}
+
+		// The socket has to exist before ~/.zlogin points at it
+		if sshAgentService {
+			setup_commands = insertBefore(setup_commands, "set-zlogin",
+				CommandSpec{Name: "write-ssh-agent-service", Cmd: writeFileCmd("~/.config/systemd/user/ssh-agent.service", sshAgentUnit)},
+				CommandSpec{Name: "enable-ssh-agent-service", Cmd: "sudo loginctl enable-linger $USER && systemctl --user daemon-reload && systemctl --user enable --now ssh-agent"},
+			)
+		}
+
+		if cfg.GetBool("cleanup") {
+			cleanup := CommandSpec{Name: "cleanup-cache", Cmd: cleanCacheCmd(packageDistribution)}
+			if useDevContainer {
+				cleanup.Container = devContainerName
+			}
+			setup_commands = append(setup_commands, cleanup)
+		}
+
+		if cfg.GetBool("warmCargoCache") {
+			warm := CommandSpec{Name: "warm-cargo-cache", Cmd: warmCargoCacheCmd()}
+			if useDevContainer {
+				warm.Container = devContainerName
+			}
+			setup_commands = insertBefore(setup_commands, "install-cargo-packages", warm)
+		}
+
+		// The flake provides the tools rustup and cargo would, the system
+		// packages stay since the rest of the setup relies on them
+		if flake := cfg.Get("nixFlake"); flake != "" {
+			i := slices.IndexFunc(setup_commands, func(c CommandSpec) bool { return c.Name == "install-cargo" })
+			container := setup_commands[i].Container
+			setup_commands = slices.DeleteFunc(setup_commands, func(c CommandSpec) bool {
+				return slices.Contains([]string{"install-cargo", "warm-cargo-cache", "install-cargo-packages"}, c.Name)
+			})
+			setup_commands = slices.Insert(setup_commands, i,
+				CommandSpec{Name: "install-nix", Cmd: nixInstallCmd, Condition: nixMissing, Container: container},
+				CommandSpec{Name: "setup-nix-flake", Cmd: nixDevelopCmd(flake), Container: container},
+			)
+		}
+
+		mode := cfg.Get("mode")
+		if mode == "" {
+			mode = "full"
+		}
+		if setup_commands, err = filterCommandsForMode(setup_commands, mode); err != nil {
+			return err
+		}
+
+		// One parallel command per crate so they build concurrently. The
+		// no-op install-cargo-packages that replaces them in the chain waits
+		// for all of them, so the commands after it still wait too.
+		if i := slices.IndexFunc(setup_commands, func(c CommandSpec) bool { return c.Name == "install-cargo-packages" }); i > 0 && cfg.GetBool("parallelCargoInstall") {
+			all, after := setup_commands[i], setup_commands[i-1].Name
+
+			join := CommandSpec{Name: all.Name, Cmd: "true", RerunWithAfter: true}
+			var cargoInstalls []CommandSpec
+			for _, crate := range crates {
+				c := all
+				c.Name = "install-cargo-package-" + crate.Name
+				c.Cmd = cargoInstallCmd([]CargoPinnedPackage{crate})
+				c.After = []string{after}
+				c.Parallel = true
+				cargoInstalls = append(cargoInstalls, c)
+				join.After = append(join.After, c.Name)
+			}
+			setup_commands = slices.Replace(setup_commands, i, i+1, append(cargoInstalls, join)...)
+		}
+
+		// These run independently
+		extra_commands := []CommandSpec{
+			{Name: "install-starship", Cmd: "curl -sS https://starship.rs/install.sh | sudo sh -s -- -y", SkipIf: starshipInstalled},
+			{Name: "install-uv", Cmd: "curl -LsSf https://astral.sh/uv/install.sh | UV_NO_MODIFY_PATH=1 sh", SkipIf: uvInstalled},
+		}
+
+		// starship goes to /usr/local/bin, which the container doesn't share.
+		// Everything else only writes to the shared home directory.
+		if useDevContainer {
+			extra_commands[0].Container = devContainerName
+			extra_commands[0].After = []string{"create-distrobox"}
+		}
+
+		if neovimVersion != "" && neovimVersion != "stable" {
+			if targetArch == "amd64" || targetArch == "arm64" {
+				cmd, err := neovimAppImageCmd(neovimVersion, targetArch)
+				if err != nil {
+					return err
+				}
+				extra_commands = append(extra_commands, CommandSpec{Name: "install-neovim", Cmd: cmd, Condition: archCondition(targetArch)})
+			} else {
+				ctx.Log.Warn(fmt.Sprintf("There is no neovim AppImage for %s, skipping neovimVersion", targetArch), nil)
+			}
+		}
+
+		// uv doesn't read pip.conf, so both get the mirror
+		if mirror := cfg.Get("pypiMirror"); mirror != "" {
+			extra_commands = append(extra_commands, CommandSpec{
+				Name: "configure-pypi",
+				Cmd: writeFileCmd("~/.config/uv/uv.toml", fmt.Sprintf("index-url = %q", mirror)) + " && " +
+					writeFileCmd("~/.pip/pip.conf", "[global]\nindex-url = "+mirror),
+			})
+		}
+
+		// The framework lives in ~/.emacs.d and loads the cloned config
+		if repo := cfg.Get("emacsConfigRepo"); installEmacs && repo != "" {
+			var configDir, frameworkCmd string
+			switch framework := cmp.Or(cfg.Get("emacsFramework"), "doom"); framework {
+			case "doom":
+				configDir = "~/.config/doom"
+				frameworkCmd = "git clone --depth 1 https://github.com/doomemacs/doomemacs ~/.emacs.d && ~/.emacs.d/bin/doom install --force"
+			case "spacemacs":
+				configDir = "~/.spacemacs.d"
+				frameworkCmd = "git clone --depth 1 https://github.com/syl20bnr/spacemacs ~/.emacs.d"
+			default:
+				return fmt.Errorf("unsupported emacsFramework: %s", framework)
+			}
+
+			extra_commands = append(extra_commands,
+				CommandSpec{
+					Name:      "setup-emacs-config",
+					Cmd:       fmt.Sprintf("git clone %s %s", shellQuote(repo), configDir),
+					Condition: fmt.Sprintf("[ ! -e %s ]", configDir),
+					After:     []string{"install-packages"},
+				},
+				CommandSpec{
+					Name:      "install-emacs-framework",
+					Cmd:       frameworkCmd,
+					Condition: "[ ! -e ~/.emacs.d ]",
+					After:     []string{"setup-emacs-config"},
+				},
+			)
+		}
+
+		if jsInstallCmd != "" {
+			extra_commands = append(extra_commands, CommandSpec{Name: "install-js-toolchain", Cmd: jsInstallCmd})
+		}
+
+		if len(systemEnv) > 0 && isLinux(distribution) {
+			extra_commands = append(extra_commands, CommandSpec{Name: "setup-system-env", Cmd: systemEnvCmd(systemEnv)})
+		}
+
+		// An existing ghostty config from setup-config wins over the repo
+		if repo := cfg.Get("ghosttyConfigRepo"); repo != "" {
+			extra_commands = append(extra_commands, CommandSpec{
+				Name:      "setup-ghostty",
+				Cmd:       fmt.Sprintf("git clone %s ~/.config/ghostty", shellQuote(repo)),
+				Condition: "[ ! -e ~/.config/ghostty ]",
+				After:     []string{"setup-config"},
+			})
+		} else if inline := cfg.Get("ghosttyConfigInline"); inline != "" {
+			extra_commands = append(extra_commands, CommandSpec{
+				Name:  "setup-ghostty",
+				Cmd:   writeFileCmd("~/.config/ghostty/config", inline),
+				After: []string{"setup-config"},
+			})
+		}
+
+		// The dotfiles may have a rustfmt.toml already, only the edition is
+		// replaced. A second edition key would make it invalid.
+		var configureCargo []string
+		if rustEdition != "" {
+			rustfmt := "~/.config/rustfmt/rustfmt.toml"
+			configureCargo = append(configureCargo,
+				fmt.Sprintf("mkdir -p %s && touch %s && sed -i.bak '/^edition *=/d' %s && rm -f %s.bak", path.Dir(rustfmt), rustfmt, rustfmt, rustfmt),
+				managedBlockCmd(rustfmt, "devenv", fmt.Sprintf("edition = \"%s\"", rustEdition), false),
+			)
+		}
+		if len(cargoConfig) > 0 {
+			configureCargo = append(configureCargo, managedBlockCmd("~/.cargo/config.toml", "devenv", strings.Join(cargoConfig, "\n\n"), false))
+		}
+		if len(configureCargo) > 0 {
+			extra_commands = append(extra_commands, CommandSpec{Name: "configure-cargo", Cmd: strings.Join(configureCargo, " && "), After: []string{configureCargoAfter}})
+		}
+
+		// After setup-config so these settings win over the dotfiles
+		if gitConfigCmd := generateGitConfigCmd(gitConfig); gitConfigCmd != "" {
+			extra_commands = append(extra_commands, CommandSpec{Name: "setup-gitconfig", Cmd: gitConfigCmd, After: []string{"setup-config"}})
+		}
+
+		// git lfs install adds its filters to ~/.gitconfig
+		if installGitLFS {
+			lfsAfter := []string{"setup-config", "install-packages"}
+			if distribution == "ubuntu" {
+				extra_commands = append(extra_commands, CommandSpec{
+					Name:      "install-git-lfs",
+					Cmd:       "curl -fsSL https://packagecloud.io/install/repositories/github/git-lfs/script.deb.sh | sudo bash && sudo apt-get install -y git-lfs",
+					Condition: "! command -v git-lfs > /dev/null",
+					After:     []string{"install-packages"},
+				})
+				lfsAfter = []string{"setup-config", "install-git-lfs"}
+			}
+
+			lfsCmd := "git lfs install"
+			if cachePath := cfg.Get("gitLFSCachePath"); cachePath != "" {
+				lfsCmd += fmt.Sprintf(" && git config --global lfs.storage %s", shellQuote(cachePath))
+			}
+			c := CommandSpec{Name: "configure-git-lfs", Cmd: lfsCmd, After: lfsAfter}
+			if useDevContainer {
+				c.Container = devContainerName
+			}
+			extra_commands = append(extra_commands, c)
+		}
+
+		if len(rustCrossTargets) > 0 {
+			extra_commands = append(extra_commands, CommandSpec{
+				Name:  "add-rust-targets",
+				Cmd:   fmt.Sprintf("~/.cargo/bin/rustup target add %s", strings.Join(rustCrossTargets, " ")),
+				After: []string{"install-cargo"},
+			})
+		}
+
+		// ccache runs the real compiler named like the link it's called through
+		if installCcache {
+			extra_commands = append(extra_commands, CommandSpec{
+				Name:  "configure-ccache",
+				Cmd:   `mkdir -p ~/.local/bin && ln -sf "$(command -v ccache)" ~/.local/bin/cc && ln -sf "$(command -v ccache)" ~/.local/bin/c++`,
+				After: []string{"install-packages"},
+			})
+		}
+
+		// Exported as installedCargoPackages
+		extra_commands = append(extra_commands, CommandSpec{Name: "cargo-audit-output", Cmd: "~/.cargo/bin/cargo install --list", After: []string{"install-cargo-packages"}, RerunWithAfter: true})
+
+		// The crate is git-delta, the binary delta
+		useGitDelta, err := cfg.TryBool("useGitDelta")
+		if err != nil {
+			useGitDelta = slices.ContainsFunc(crates, func(p CargoPinnedPackage) bool { return p.Name == "git-delta" })
+		}
+		if useGitDelta {
+			extra_commands = append(extra_commands, CommandSpec{
+				Name: "setup-git-delta",
+				Cmd: strings.Join([]string{
+					"git config --global core.pager delta",
+					"git config --global interactive.diffFilter 'delta --color-only'",
+					"git config --global delta.navigate true",
+					"git config --global delta.light false",
+				}, " && "),
+				After: []string{"install-cargo-packages", "setup-config"},
+			})
+		}
+
+		if installLLDB {
+			extra_commands = append(extra_commands, CommandSpec{Name: "setup-lldbinit", Cmd: writeFileCmd("~/.lldbinit", "settings set target.x86-disassembly-flavor intel")})
+		}
+
+		// Lets bpftrace and perf run without root
+		if cfg.GetBool("setupBPFPerms") && isLinux(distribution) {
+			extra_commands = append(extra_commands, CommandSpec{
+				Name: "configure-bpf-perms",
+				Cmd:  fmt.Sprintf("%s && sudo sysctl -p /etc/sysctl.d/99-bpf.conf", sudoWriteFileCmd("/etc/sysctl.d/99-bpf.conf", bpfSysctl)),
+			})
+		}
+
+		// Apport and abrt set their own core_pattern whenever they start,
+		// Ubuntu's apport is stopped for good
+		if configureCoredump {
+			cmd := fmt.Sprintf("%s && sudo sysctl --system", sudoWriteFileCmd("/etc/sysctl.d/99-coredump.conf", coredumpSysctl))
+			if distribution == "ubuntu" {
+				cmd = "(sudo systemctl disable --now apport.service 2> /dev/null || true) && " + cmd
+			}
+			extra_commands = append(extra_commands, CommandSpec{Name: "configure-coredump", Cmd: cmd, After: []string{"install-packages"}})
+		}
+
+		// Restarted so a changed port applies
+		if installNodeExporter {
+			port := cfg.GetInt("nodeExporterPort")
+			if port == 0 {
+				port = 9100
+			}
+			extra_commands = append(extra_commands, CommandSpec{
+				Name: "enable-node-exporter",
+				Cmd: fmt.Sprintf("%s && sudo systemctl enable prometheus-node-exporter && sudo systemctl restart prometheus-node-exporter",
+					sudoWriteFileCmd("/etc/default/prometheus-node-exporter", fmt.Sprintf(`ARGS="--web.listen-address=:%d"`, port))),
+				After: []string{"install-packages"},
+			})
+		}
+
+		if signingKey := cfg.Get("gitSigningKey"); signingKey != "" {
+			signingCmd, err := gitSigningCmd(signingKey, cfg.Get("gitSigningMethod"), cfg.Get("importGPGKey"))
+			if err != nil {
+				return err
+			}
+			extra_commands = append(extra_commands, CommandSpec{Name: "setup-git-signing", Cmd: signingCmd, After: []string{"setup-config"}})
+		}
+
+		// Restart the agent so a running one picks up the config
+		if useGPGAgent {
+			extra_commands = append(extra_commands, CommandSpec{
+				Name:  "configure-gpg-agent",
+				Cmd:   fmt.Sprintf("%s && chmod 700 ~/.gnupg && gpgconf --kill gpg-agent", writeFileCmd("~/.gnupg/gpg-agent.conf", "enable-ssh-support")),
+				After: []string{"install-packages"},
+			})
+		}
+
+		if cfg.GetBool("configureLimits") && isLinux(distribution) {
+			var customLimits map[string]string
+			if err := cfg.GetObject("customLimits", &customLimits); err != nil {
+				return fmt.Errorf("failed to parse customLimits: %w", err)
+			}
+			extra_commands = append(extra_commands, CommandSpec{Name: "configure-limits", Cmd: limitsCmd(customLimits)})
+		}
+
+		if thpMode := cfg.Get("thpMode"); thpMode != "" && isLinux(distribution) {
+			cmd, err := thpCmd(thpMode)
+			if err != nil {
+				return err
+			}
+			extra_commands = append(extra_commands, CommandSpec{Name: "configure-thp", Cmd: cmd})
+		}
+
+		// Most VMs don't expose frequency scaling
+		if governor := cfg.Get("cpuGovernor"); governor != "" && isLinux(distribution) {
+			cmd, err := cpuGovernorCmd(governor)
+			if err != nil {
+				return err
+			}
+			extra_commands = append(extra_commands, CommandSpec{Name: "set-cpu-governor", Cmd: cmd, Condition: "[ -d /sys/devices/system/cpu/cpu0/cpufreq ]"})
+		}
+
+		// Nothing installs Docker here, the step only applies where it already is
+		var dockerDaemonConfig map[string]interface{}
+		if err := cfg.GetObject("dockerDaemonConfig", &dockerDaemonConfig); err != nil {
+			return fmt.Errorf("failed to parse dockerDaemonConfig: %w", err)
+		}
+		if enableBuildKit {
+			if dockerDaemonConfig == nil {
+				dockerDaemonConfig = map[string]interface{}{}
+			}
+			features, _ := dockerDaemonConfig["features"].(map[string]interface{})
+			if features == nil {
+				features = map[string]interface{}{}
+			}
+			features["buildkit"] = true
+			dockerDaemonConfig["features"] = features
+		}
+		if len(dockerDaemonConfig) > 0 && isLinux(distribution) {
+			daemonJSON, err := json.MarshalIndent(dockerDaemonConfig, "", "  ")
+			if err != nil {
+				return fmt.Errorf("failed to encode dockerDaemonConfig: %w", err)
+			}
+			extra_commands = append(extra_commands, CommandSpec{
+				Name:      "configure-docker-daemon",
+				Cmd:       fmt.Sprintf("%s && sudo systemctl restart docker", sudoWriteFileCmd("/etc/docker/daemon.json", string(daemonJSON))),
+				Condition: "command -v dockerd > /dev/null",
+			})
+		}
+
+		var oomConfig map[string]int
+		if err := cfg.GetObject("oomConfig", &oomConfig); err != nil {
+			return fmt.Errorf("failed to parse oomConfig: %w", err)
+		}
+		if len(oomConfig) > 0 && isLinux(distribution) {
+			cmd, err := oomConfigCmd(oomConfig)
+			if err != nil {
+				return err
+			}
+			extra_commands = append(extra_commands, CommandSpec{Name: "oom-config", Cmd: cmd, NotifyHandler: "systemd-daemon-reload"})
+		}
+
+		if installFail2ban {
+			extra_commands = append(extra_commands,
+				CommandSpec{Name: "configure-fail2ban", Cmd: sudoWriteFileCmd("/etc/fail2ban/jail.d/sshd.conf", fail2banSSHJail), After: []string{"install-packages"}},
+				CommandSpec{Name: "enable-fail2ban", Cmd: "sudo systemctl enable --now fail2ban && sudo systemctl restart fail2ban", After: []string{"configure-fail2ban"}},
+			)
+		}
+
+		// The seed is a secret, the command embeds the private key
+		if cfg.GetBool("generateSSHHostKey") {
+			hostKeyCmd, err := sshHostKeyCmd(cfg.Require("sshHostKeySeed"))
+			if err != nil {
+				return fmt.Errorf("failed to generate SSH host key: %w", err)
+			}
+			extra_commands = append(extra_commands, CommandSpec{Name: "setup-ssh-host-key", Cmd: hostKeyCmd, Secret: true})
+		}
+
+		// Plaintext here like shellSecrets, setup-npmrc is a secret command
+		var npmrc map[string]string
+		if _, err := cfg.GetSecretObject("npmrc", &npmrc); err != nil {
+			return fmt.Errorf("failed to parse npmrc: %w", err)
+		}
+		if len(npmrc) > 0 {
+			c := CommandSpec{Name: "setup-npmrc", Cmd: npmrcCmd(npmrc), Secret: true}
+			if jsInstallCmd != "" {
+				c.After = []string{"install-js-toolchain"}
+			}
+			extra_commands = append(extra_commands, c)
+		}
+
+		// ssh refuses a config that others can write to
+		if content := sshClientConfig(cfg.Get("sshClientConfig"), sshClientConfigEntries); content != "" {
+			extra_commands = append(extra_commands, CommandSpec{
+				Name: "setup-ssh-client-config",
+				Cmd:  fmt.Sprintf("mkdir -p -m 700 ~/.ssh && %s && chmod 600 ~/.ssh/config", writeFileCmd("~/.ssh/config", content)),
+			})
+		}
+
+		if len(additionalSSHKeys) > 0 {
+			extra_commands = append(extra_commands, CommandSpec{Name: "setup-authorized-keys", Cmd: authorizedKeysCmd(additionalSSHKeys)})
+		}
+
+		// Exported as userSSHPublicKey. ssh-keygen leaves an existing key alone.
+		if cfg.GetBool("generateUserSSHKey") {
+			keyType := cfg.Get("userSSHKeyType")
+			if keyType == "" {
+				keyType = "ed25519"
+			}
+			if !slices.Contains([]string{"ed25519", "ecdsa", "rsa"}, keyType) {
+				return fmt.Errorf("unsupported userSSHKeyType: %s", keyType)
+			}
+			key := "~/.ssh/id_" + keyType
+			extra_commands = append(extra_commands, CommandSpec{
+				Name: "generate-user-ssh-key",
+				Cmd:  fmt.Sprintf(`mkdir -p -m 700 ~/.ssh && ([ -f %s ] || ssh-keygen -q -t %s -f %s -N "") && cat %s.pub`, key, keyType, key, key),
+			})
+		}
+
+		var hostsEntries map[string]string
+		if err := cfg.GetObject("hostsEntries", &hostsEntries); err != nil {
+			return fmt.Errorf("failed to parse hostsEntries: %w", err)
+		}
+		if len(hostsEntries) > 0 {
+			cmd, err := hostsCmd(hostsEntries)
+			if err != nil {
+				return err
+			}
+			extra_commands = append(extra_commands, CommandSpec{Name: "configure-hosts", Cmd: cmd})
+		}
+
+		// curl and the apt sources come with install-packages
+		if cfg.GetBool("installVault") {
+			cmd, err := vaultInstallCmd(packageDistribution)
+			if err != nil {
+				return err
+			}
+			c := CommandSpec{Name: "install-vault", Cmd: cmd, Condition: "! command -v vault > /dev/null", After: []string{"install-packages"}}
+			if useDevContainer {
+				c.Container = devContainerName
+			}
+			extra_commands = append(extra_commands, c)
+		}
+
+		if cfg.GetBool("configureVaultAgent") {
+			file := "~/.config/vault/vault-agent.hcl"
+			extra_commands = append(extra_commands, CommandSpec{Name: "configure-vault-agent", Cmd: fmt.Sprintf(`%s && sed -i.bak "s|~/|$HOME/|" %s && rm -f %s.bak`, writeFileCmd(file, vaultAgentConfig), file, file)})
+		}
+
+		if len(shellSecrets) > 0 {
+			extra_commands = append(extra_commands, CommandSpec{Name: "setup-secrets", Cmd: secretsCmd(shellSecrets), Secret: true})
+		}
+
+		// GUI apps on macOS are only available as casks
+		if distribution == "macos" && len(brewCaskPackages) > 0 {
+			extra_commands = append(extra_commands, CommandSpec{Name: "install-cask-packages", Cmd: fmt.Sprintf("brew install --cask %s", strings.Join(brewCaskPackages, " "))})
+		}
+
+		extra_commands = append(extra_commands, profile.AdditionalCommands...)
+
+		// After setup-config, oh-my-zsh replaces its ~/.zshrc. zshrcAfter is
+		// the last command that rewrote it.
+		zshrcAfter := "setup-config"
+		if zshPlugin == "oh-my-zsh" {
+			zshrcAfter = "install-oh-my-zsh"
+			extra_commands = append(extra_commands, CommandSpec{Name: "install-oh-my-zsh", Cmd: ohMyZshInstallCmd, Condition: "[ ! -d ~/.oh-my-zsh ]", After: []string{"setup-config"}})
+
+			themeAfter := []string{"install-oh-my-zsh"}
+			if zshTheme == "powerlevel10k" {
+				extra_commands = append(extra_commands, CommandSpec{
+					Name:      "install-p10k",
+					Cmd:       "git clone --depth=1 https://github.com/romkatv/powerlevel10k.git ~/.oh-my-zsh/custom/themes/powerlevel10k",
+					Condition: "[ ! -d ~/.oh-my-zsh/custom/themes/powerlevel10k ]",
+					After:     themeAfter,
+				})
+				themeAfter = []string{"install-p10k"}
+			}
+
+			if zshTheme != "" {
+				extra_commands = append(extra_commands, CommandSpec{Name: "set-zsh-theme", Cmd: zshThemeCmd(zshTheme), After: themeAfter})
+				zshrcAfter = "set-zsh-theme"
+			}
+		}
+
+		// conda init edits ~/.zshrc, which setup-config and the oh-my-zsh
+		// installer would overwrite
+		if cfg.GetBool("installConda") {
+			extra_commands = append(extra_commands,
+				CommandSpec{Name: "install-miniforge", Cmd: miniforgeInstallCmd, Condition: "[ ! -d ~/miniforge3 ]"},
+				CommandSpec{Name: "conda-init", Cmd: "~/miniforge3/bin/conda init zsh", After: []string{"install-miniforge", zshrcAfter}},
+			)
+
+			// The environment file is read locally and written to the host
+			if file := cfg.Get("condaEnvFile"); file != "" {
+				env, err := os.ReadFile(file)
+				if err != nil {
+					return fmt.Errorf("failed to read condaEnvFile: %w", err)
+				}
+				extra_commands = append(extra_commands, CommandSpec{
+					Name:  "create-conda-env",
+					Cmd:   fmt.Sprintf("%s && ~/miniforge3/bin/conda env update -f ~/.config/devenv/environment.yml", writeFileCmd("~/.config/devenv/environment.yml", strings.TrimSpace(string(env)))),
+					After: []string{"install-miniforge"},
+				})
+			}
+		}
+
+		// Needs git, cmake and a compiler from install-packages
+		if installVcpkg {
+			vcpkg := []CommandSpec{{
+				Name:      "install-vcpkg",
+				Cmd:       "rm -rf ~/.vcpkg && git clone https://github.com/microsoft/vcpkg.git ~/.vcpkg && ~/.vcpkg/bootstrap-vcpkg.sh -disableMetrics",
+				Condition: "[ ! -x ~/.vcpkg/vcpkg ]",
+				After:     []string{"install-packages"},
+			}}
+			var ports []string
+			if err := cfg.GetObject("vcpkgPackages", &ports); err != nil {
+				return fmt.Errorf("failed to parse vcpkgPackages: %w", err)
+			}
+			if len(ports) > 0 {
+				vcpkg = append(vcpkg, CommandSpec{
+					Name:  "install-vcpkg-packages",
+					Cmd:   fmt.Sprintf("VCPKG_ROOT=~/.vcpkg ~/.vcpkg/vcpkg install %s", strings.Join(ports, " ")),
+					After: []string{"install-vcpkg"},
+				})
+			}
+			if useDevContainer {
+				for i := range vcpkg {
+					vcpkg[i].Container = devContainerName
+				}
+			}
+			extra_commands = append(extra_commands, vcpkg...)
+		}
+
+		if llvmConfigCmd != "" {
+			extra_commands = append(extra_commands, CommandSpec{Name: "configure-llvm-config", Cmd: llvmConfigCmd, After: []string{"install-packages"}})
+		}
+
+		if installJava {
+			var buildTools []string
+			if err := cfg.GetObject("javaBuildTools", &buildTools); err != nil {
+				return fmt.Errorf("failed to parse javaBuildTools: %w", err)
+			}
+			cmds, err := javaCommands(cfg.Get("javaVersion"), buildTools, map[string]string{"gradle": cfg.Get("gradleVersion"), "maven": cfg.Get("mavenVersion")})
+			if err != nil {
+				return err
+			}
+			extra_commands = append(extra_commands, cmds...)
+		}
+
+		if installAsdf {
+			var asdfPlugins []AsdfPlugin
+			if err := cfg.GetObject("asdfPlugins", &asdfPlugins); err != nil {
+				return fmt.Errorf("failed to parse asdfPlugins: %w", err)
+			}
+			var asdfVersions map[string]string
+			if err := cfg.GetObject("asdfVersions", &asdfVersions); err != nil {
+				return fmt.Errorf("failed to parse asdfVersions: %w", err)
+			}
+			extra_commands = append(extra_commands, asdfCommands(asdfPlugins, asdfVersions)...)
+		}
+
+		for _, rule := range udevRules {
+			cmd, err := udevRuleCmd(rule)
+			if err != nil {
+				return err
+			}
+			extra_commands = append(extra_commands, CommandSpec{Name: "setup-udev-rule-" + rule.Name, Cmd: cmd, NotifyHandler: "reload-udev"})
+		}
+
+		if cfg.GetBool("scheduleAutoUpdate") {
+			if err := scheduleAutoUpdate(ctx, cmp.Or(cfg.Get("updateCron"), "daily")); err != nil {
+				return err
+			}
+		}
+
+		// Exported as sshFingerprint, once the host key can't change anymore,
+		// and again whenever setup-ssh-host-key replaces it. Container images
+		// have no host keys.
+		fingerprint := CommandSpec{
+			Name:           "export-ssh-fingerprint",
+			Cmd:            "ssh-keygen -l -f /etc/ssh/ssh_host_ed25519_key.pub",
+			Condition:      "[ -f /etc/ssh/ssh_host_ed25519_key.pub ]",
+			RerunWithAfter: true,
+		}
+		if slices.ContainsFunc(extra_commands, func(c CommandSpec) bool { return c.Name == "setup-ssh-host-key" }) {
+			fingerprint.After = []string{"setup-ssh-host-key"}
+		}
+		extra_commands = append(extra_commands, fingerprint)
+
+		// Extra commands that depend on a skipped command are skipped too
+		extra_commands = withoutOrphans(extra_commands, setup_commands)
+
+		extras := CommandGroup{
+			Name:     "extra",
+			Commands: extra_commands,
+			Handlers: []CommandSpec{
+				{Name: "systemd-daemon-reload", Cmd: "sudo systemctl daemon-reload"},
+				{Name: "reload-udev", Cmd: "sudo udevadm control --reload-rules && sudo udevadm trigger"},
+			},
+		}
+		handlers := extras.notifiedHandlers()
+
+		// WSL only runs systemd when it's enabled in /etc/wsl.conf. chsh needs
+		// no change, wsl.exe starts the login shell from /etc/passwd too.
+		if wsl {
+			for _, commands := range [][]CommandSpec{setup_commands, extra_commands, handlers} {
+				for i, c := range commands {
+					if !strings.Contains(c.Cmd, "systemctl") {
+						continue
+					}
+
+					commands[i].Condition = addCondition(c.Condition, systemdRunning)
+				}
+			}
+		}
+
+		vars := TemplateVars{Username: sshUsername, Distribution: distribution, Arch: targetArch}
+		if err := renderCommands(setup_commands, vars); err != nil {
+			return err
+		}
+		if err := renderCommands(extra_commands, vars); err != nil {
+			return err
+		}
+
+		commands, err := deduplicateCommands(setup_commands, extra_commands, handlers)
+		if err != nil {
+			return err
+		}
+
+		// Run last, the generated files leave them out
+		var users []UserConfig
+		if err := cfg.GetObject("users", &users); err != nil {
+			return fmt.Errorf("failed to parse users: %w", err)
+		}
+		var user_commands []CommandSpec
+		for _, user := range users {
+			cmds, err := userCommands(user)
+			if err != nil {
+				return fmt.Errorf("failed to provision user '%s': %w", user.Username, err)
+			}
+			user_commands = append(user_commands, cmds...)
+		}
+		if _, err := deduplicateCommands(commands, user_commands); err != nil {
+			return err
+		}
+
+		// Both may contain secrets, only the user gets to read them
+		if cfg.GetBool("generateScript") {
+			script := generateProvisionScript(commands, sshTarget(sshUsername, orbMachine, wsl))
+			if err := writeGeneratedFile("provision.sh", []byte(script), 0o700); err != nil {
+				return fmt.Errorf("failed to write provision.sh: %w", err)
+			}
+		}
+		if cfg.GetBool("generateMakefile") {
+			makefile := generateMakefile(setup_commands, slices.Concat(extra_commands, handlers), sshTarget(sshUsername, orbMachine, wsl))
+			if err := writeGeneratedFile("Makefile", []byte(makefile), 0o600); err != nil {
+				return fmt.Errorf("failed to write Makefile: %w", err)
+			}
+		}
+
+		if cfg.GetBool("generateNixFlake") {
+			var crateNames []string
+			for _, c := range crates {
+				crateNames = append(crateNames, c.Name)
+			}
+			flake := generateNixFlake(strings.Fields(packages), crateNames)
+			if err := os.WriteFile("flake.nix", []byte(flake), 0o644); err != nil {
+				return fmt.Errorf("failed to write flake.nix: %w", err)
+			}
+		}
+
+		buildImage := cfg.GetBool("buildAndPushImage")
+		if cfg.GetBool("generateDockerfile") || buildImage {
+			dockerfile, err := generateDockerfile(distribution, sshUsername, commands)
+			if err != nil {
+				return fmt.Errorf("failed to generate Dockerfile: %w", err)
+			}
+			if err := writeGeneratedFile("Dockerfile", []byte(dockerfile), 0o600); err != nil {
+				return fmt.Errorf("failed to write Dockerfile: %w", err)
+			}
+
+			// Built on every run, docker's layer cache keeps unchanged ones
+			if buildImage {
+				image := fmt.Sprintf("%s/%s:%s", cfg.Require("imageRegistry"), cfg.Require("imageName"), cmp.Or(cfg.Get("imageTag"), "latest"))
+				if !ctx.DryRun() {
+					if err := buildAndPushImage(dockerfile, image); err != nil {
+						return err
+					}
+					ctx.Log.Info(fmt.Sprintf("Pushed image %s", image), nil)
+				}
+				ctx.Export("image", pulumi.String(image))
+			}
+		}
+
+		// The host runs the commands itself on first boot, nothing is dialed
+		if cfg.GetBool("useCloudInit") {
+			if slices.ContainsFunc(commands, func(c CommandSpec) bool { return c.RequiresReboot }) {
+				return fmt.Errorf("useCloudInit is not supported on %s, its setup needs reboots", distribution)
+			}
+
+			var userData pulumi.Output = pulumi.String(generateCloudInit(commands, sshUsername)).ToStringOutput()
+			if slices.ContainsFunc(commands, func(c CommandSpec) bool { return c.Secret }) {
+				userData = pulumi.ToSecret(userData)
+			}
+			ctx.Export("cloudInit", userData)
+			return nil
+		}
+
+		connection, err := sshConnection(sshUsername, orbMachine, wsl)
+		if err != nil {
+			return err
+		}
+
+		// The generated files run the commands without tmux. Secret commands
+		// would leave their output in the scrollback.
+		if useRemoteSession {
+			for _, commands := range [][]CommandSpec{setup_commands, extra_commands, handlers} {
+				for i := range commands {
+					if !commands[i].Secret {
+						commands[i].Session = "provision-" + commands[i].Name
+					}
+				}
+			}
+		}
+
+		if cfg.GetBool("trustHostKey") && !ctx.DryRun() {
+			if err := trustHostKey(sshTarget(sshUsername, orbMachine, wsl)); err != nil {
+				return err
+			}
+		}
+
+		created := map[string]*remote.Command{}
+		verbose := cfg.GetBool("verboseOutputs")
+
+		// The log file shares the benchmark's bookkeeping
+		var bench *benchmark
+		logFile := cfg.Get("logFile")
+		if cfg.GetBool("benchmark") || logFile != "" {
+			bench = newBenchmark()
+		}
+
+		// Setup the base system
+		rebooted, err := runOrderedCommands(ctx, setup_commands, connection, created, verbose, bench)
+		if err != nil {
+			ctx.Log.Error(fmt.Sprintf("Failed to run base commands: %v", err), nil)
+			return err
+		}
+
+		// Nothing else may run while the host reboots
+		if rebooted != "" {
+			for _, commands := range [][]CommandSpec{extra_commands, user_commands} {
+				for i := range commands {
+					commands[i].After = append(slices.Clone(commands[i].After), rebooted)
+				}
+			}
+		}
+
+		ctx.Export("arch", created["check-arch"].Stdout.ApplyT(strings.TrimSpace))
+
+		// The rest
+		if err := runIndependentCommands(ctx, extra_commands, connection, created, verbose, bench); err != nil {
+			ctx.Log.Error(fmt.Sprintf("Failed to run setup commands: %v", err), nil)
+			return err
+		}
+
+		if err := runHandlers(ctx, handlers, connection, created, verbose, bench); err != nil {
+			ctx.Log.Error(fmt.Sprintf("Failed to run handlers: %v", err), nil)
+			return err
+		}
+
+		if err := runIndependentCommands(ctx, user_commands, connection, created, verbose, bench); err != nil {
+			ctx.Log.Error(fmt.Sprintf("Failed to provision users: %v", err), nil)
+			return err
+		}
+
+		if r, ok := created["cargo-audit-output"]; ok {
+			ctx.Export("installedCargoPackages", r.Stdout)
+		}
+		if r, ok := created["export-ssh-fingerprint"]; ok {
+			ctx.Export("sshFingerprint", r.Stdout.ApplyT(strings.TrimSpace))
+		}
+		if r, ok := created["generate-user-ssh-key"]; ok {
+			ctx.Export("userSSHPublicKey", r.Stdout.ApplyT(strings.TrimSpace))
+		}
+
+		if cfg.GetBool("createSnapshot") && !ctx.DryRun() {
+			snapshot := cfg.Get("snapshotName")
+			if snapshot == "" {
+				snapshot = "post-provision-" + time.Now().UTC().Format("20060102-150405")
+			}
+			snapshotOrbMachineAfter(ctx, cfg.Require("orbMachineName"), snapshot, created)
+		}
+
+		if cfg.GetBool("benchmark") {
+			bench.report(ctx)
+		}
+		if logFile != "" {
+			bench.writeLog(ctx, logFile)
 		}
 
 		ctx.Log.Info(fmt.Sprintf("%s setup complete.", distribution), nil)
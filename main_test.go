@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+func TestCronToOnCalendar(t *testing.T) {
+	tests := []struct {
+		expr    string
+		want    string
+		wantErr bool
+	}{
+		{expr: "daily", want: "daily"},
+		{expr: "Mon *-*-* 03:00:00", want: "Mon *-*-* 03:00:00"},
+		{expr: "* * * * *", want: "*-*-* *:*:00"},
+		{expr: "30 4 * * *", want: "*-*-* 4:30:00"},
+		{expr: "*/15 * * * *", want: "*-*-* *:0/15:00"},
+		{expr: "0 9-17/2 * * *", want: "*-*-* 9..17/2:0:00"},
+		{expr: "0 0 1,15 * *", want: "*-*-1,15 0:0:00"},
+		{expr: "0 0 */2 1-6 *", want: "*-1..6-1/2 0:0:00"},
+		{expr: "0 3 * * 0", want: "Sun *-*-* 3:0:00"},
+		{expr: "0 3 * * 7", want: "Sun *-*-* 3:0:00"},
+		{expr: "0 3 * * 1-5", want: "Mon,Tue,Wed,Thu,Fri *-*-* 3:0:00"},
+		{expr: "0 3 * * 0-5", want: "Sun,Mon,Tue,Wed,Thu,Fri *-*-* 3:0:00"},
+		{expr: "0 3 * * 5-7", want: "Fri,Sat,Sun *-*-* 3:0:00"},
+		{expr: "0 3 * * 0-7", want: "Sun,Mon,Tue,Wed,Thu,Fri,Sat *-*-* 3:0:00"},
+		{expr: "0 3 * * 6,0", want: "Sat,Sun *-*-* 3:0:00"},
+		{expr: "0 3 * * 1,3-4", want: "Mon,Wed,Thu *-*-* 3:0:00"},
+		{expr: "0 3 * * 8", wantErr: true},
+		{expr: "0 3 * * 5-1", wantErr: true},
+		{expr: "0 3 * * */2", wantErr: true},
+		{expr: "0 3 * * mon", wantErr: true},
+		{expr: "0 17-9 * * *", wantErr: true},
+		{expr: "x 3 * * *", wantErr: true},
+		{expr: "-1 3 * * *", wantErr: true},
+		{expr: "59 23 31 12 *", want: "*-12-31 23:59:00"},
+		{expr: "60 3 * * *", wantErr: true},
+		{expr: "99 3 * * *", wantErr: true},
+		{expr: "0 24 * * *", wantErr: true},
+		{expr: "0 3 0 * *", wantErr: true},
+		{expr: "0 3 32 * *", wantErr: true},
+		{expr: "0 3 * 0 *", wantErr: true},
+		{expr: "0 3 * 13 *", wantErr: true},
+		{expr: "0 3 * 1-13 *", wantErr: true},
+		{expr: "*/0 3 * * *", wantErr: true},
+		{expr: "*/x 3 * * *", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			got, err := cronToOnCalendar(tt.expr)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("cronToOnCalendar(%q) = %q, want an error", tt.expr, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("cronToOnCalendar(%q) returned an error: %v", tt.expr, err)
+			}
+			if got != tt.want {
+				t.Errorf("cronToOnCalendar(%q) = %q, want %q", tt.expr, got, tt.want)
+			}
+		})
+	}
+}